@@ -0,0 +1,123 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+// A document on its way to becoming an article
+type Article struct {
+	Document Document
+	// Name of the markdown file and the last element of the article's URL
+	Slug string
+	// The hugo content section the article is in
+	Section string
+	// Old URLs of the article, hugo redirects them to the current one
+	Aliases      []string
+	MarkdownPath string
+	// The markdown file the article used to live in when it was renamed
+	PreviousMarkdownPath string
+	// SHA-256 of the docx the article is converted from
+	ContentSHA256 string
+	// Images copied into the hugo site for the article
+	Images []string
+}
+
+// The name of a document without the extensions drive adds to exports
+func documentName(document Document) string {
+	name := filepath.Base(document.ExportPath)
+	if document.ExportPath == "" {
+		name = filepath.Base(document.Path)
+	}
+	return strings.TrimSuffix(name, ".docx")
+}
+
+// Make a URL friendly name, hugo lowercases URLs anyway
+func slugify(name string) string {
+	var slug []rune
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			slug = append(slug, r)
+			dash = false
+		} else if !dash && len(slug) > 0 {
+			slug = append(slug, '-')
+			dash = true
+		}
+	}
+	return strings.TrimRight(string(slug), "-")
+}
+
+// The slug for a document, falling back on its ID for names without any usable characters
+func articleSlug(document Document) string {
+	slug := slugify(documentName(document))
+	if slug == "" {
+		slug = "article-" + slugify(document.ID)
+	}
+	return slug
+}
+
+// Where an article with the slug lives, a markdown file or the index of a page bundle
+func slugMarkdownPath(slug string, section string, layout string, hugoPostDirectory string) string {
+	if layout == "bundle" {
+		return hugoPostDirectory + "content/" + section + "/" + slug + "/index.md"
+	}
+	return hugoPostDirectory + "content/" + section + "/" + slug + ".md"
+}
+
+// What to move or remove to take an article down, the whole directory of a page bundle
+func articleLocation(markdownPath string) string {
+	if path.Base(markdownPath) == "index.md" {
+		return path.Dir(markdownPath)
+	}
+	return markdownPath
+}
+
+// The folder of a document within the source, e.g. "Opinion/Columns/", or "/" at the top
+func documentFolder(document Document, configuration Configuration) string {
+	folder := path.Dir(document.Path)
+	if configuration.Source == "drive" {
+		// The drive CLI keeps exports in a "<name>_exports" directory next to the document,
+		// and its paths start with the remote directory
+		if strings.HasSuffix(folder, "_exports") {
+			folder = path.Dir(folder)
+		}
+		remoteDirectory := strings.Trim(configuration.GoogleDriveRemoteDirectory, "/")
+		if remoteDirectory != "" {
+			folder = strings.TrimPrefix(strings.TrimPrefix(folder, remoteDirectory), "/")
+		}
+	}
+	return strings.Trim(folder, "./") + "/"
+}
+
+// What folders maps the deepest of them that folder is in to, or fallback when it is in none
+func deepestFolderMapping(folder string, folders map[string]string, fallback string) string {
+	mapped := fallback
+	longest := 0
+	for prefix, value := range folders {
+		prefix = strings.Trim(prefix, "/") + "/"
+		if strings.HasPrefix(folder, prefix) && len(prefix) > longest {
+			mapped = value
+			longest = len(prefix)
+		}
+	}
+	return mapped
+}
+
+// The section for a document, from the deepest folder it is in that Sections lists
+func documentSection(document Document, configuration Configuration) string {
+	return deepestFolderMapping(documentFolder(document, configuration), configuration.Sections, configuration.Section)
+}
+
+// The URL of an article with the slug
+func slugURL(slug string, section string) string {
+	return "/" + section + "/" + slug + "/"
+}
+
+// The path of an article within the content directory without the extension, e.g. articles/hello-world,
+// which is where hugo renders it and where the archive keeps it
+func contentPath(markdownPath string, hugoDirectory string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(markdownPath, hugoDirectory+"content/"), ".md"), "/index")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Prefix of the temporary files atomic writes leave behind when they are interrupted
+const atomicTempPrefix = ".driveraker-tmp-"
+
+// Write a file so that readers and crashes only ever see the old or the new contents:
+// write a temporary file next to it, flush it to disk, rename it into place and flush the directory
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	return copyFileAtomic(filePath, bytes.NewReader(data), perm)
+}
+
+// Write what a reader holds to a file the way writeFileAtomic does, for downloads too large to hold in memory
+func copyFileAtomic(filePath string, reader io.Reader, perm os.FileMode) error {
+	directory := filepath.Dir(filePath)
+	f, err := ioutil.TempFile(directory, atomicTempPrefix+filepath.Base(filePath)+"-")
+	if err != nil {
+		return err
+	}
+	tempPath := f.Name()
+	// Clean up after any failure before the rename
+	defer os.Remove(tempPath)
+	_, err = io.Copy(f, reader)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tempPath, perm)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempPath, filePath)
+	if err != nil {
+		return err
+	}
+	return syncDirectory(directory)
+}
+
+// Flush a directory so a rename in it survives a power loss
+func syncDirectory(directory string) error {
+	d, err := os.Open(directory)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Find the temporary files interrupted atomic writes left in a directory
+func leftoverTempFiles(directory string) []string {
+	matches, _ := filepath.Glob(filepath.Join(directory, atomicTempPrefix+"*"))
+	return matches
+}
+
+// Check the state file before a run and clean up after an interrupted one.
+// A corrupted manifest is reported rather than silently replaced.
+func recoverState(manifestPath string) error {
+	for _, leftover := range leftoverTempFiles(filepath.Dir(manifestPath)) {
+		fmt.Println("Removing " + leftover + " left behind by an interrupted run")
+		os.Remove(leftover)
+	}
+	contents, err := ioutil.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(strings.TrimSpace(string(contents))) == 0 {
+		return corruptStateError(manifestPath, "the file is empty")
+	}
+	_, err = readManifest(manifestPath)
+	if err != nil {
+		return corruptStateError(manifestPath, err.Error())
+	}
+	return nil
+}
+
+func corruptStateError(manifestPath string, reason string) error {
+	message := fmt.Sprintf("the state file %s is corrupted: %s", manifestPath, reason)
+	if backupExists, _ := exists(manifestPath + ".bak"); backupExists {
+		message += fmt.Sprintf("; the previous state is in %s.bak, copy it over the state file to recover", manifestPath)
+	} else {
+		message += "; remove it to sync every document again"
+	}
+	return fmt.Errorf("%s", message)
+}
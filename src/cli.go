@@ -0,0 +1,520 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const usage = `usage: driveraker [--config path] [--site name] [--wait] [--dry-run] [--interval duration] [command]
+
+commands:
+  run                    sync, convert, build and deploy, the default
+  sync                   sync the source and record which documents changed
+  convert                convert the documents the last sync found changed
+  convert <docx> [md]    convert a single docx file, to standard output without a markdown path
+  build                  compile the hugo site
+  deploy                 copy the compiled site to the production directory
+  preview                compile the site with drafts and future articles and copy it to the preview directory
+  daemon                 run every --interval, and when a scheduled article's publish date arrives
+  status                 show the run in progress, the work waiting to be done and the scheduled articles
+  reset-state            forget what was synced so the next sync starts over
+  config validate        check the configuration and show the settings in effect
+  config show            show the settings in effect with the environment overrides, secrets redacted
+
+flags:
+`
+
+// What a command works with
+type session struct {
+	configuration      Configuration
+	copyHugoSiteScript string
+	lock               *runLock
+	manifest           *Manifest
+}
+
+func main() {
+	// Get the user's home directory
+	HOME := ""
+	usr, err := user.Current()
+	if err != nil {
+		fmt.Println("[ERROR] driveraker could not get the user's home directory")
+	} else {
+		HOME = usr.HomeDir
+	}
+	configPath := flag.String("config", defaultConfigPath(HOME), "path of the driveraker configuration in JSON, TOML or YAML, the lock file and copyHugoSite.sh live next to it; DRIVERAKER_CONFIG sets the default and DRIVERAKER_* variables override settings")
+	wait := flag.Bool("wait", false, "wait for a run in progress to finish instead of exiting")
+	site := flag.String("site", "", "only process the site profile with this name")
+	interval := flag.Duration("interval", 15*time.Minute, "with daemon, how long to wait between runs when no scheduled article is due sooner")
+	dryRun := flag.Bool("dry-run", false, "with run or sync, print what would be published without writing to the hugo site, the production directory or the state; the drive CLI source compares its mirror with the state instead of pulling")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	command := "run"
+	if flag.NArg() > 0 {
+		command = flag.Arg(0)
+	}
+	// An article converted to standard output must not have the progress messages mixed in,
+	// so everything else printed goes to standard error
+	articleOutput := os.Stdout
+	if command == "convert" && flag.NArg() == 2 {
+		os.Stdout = os.Stderr
+	}
+	configDirectory := filepath.Dir(*configPath)
+	lockPath := filepath.Join(configDirectory, "driveraker.lock")
+	copyHugoSiteScript := filepath.Join(configDirectory, "copyHugoSite.sh")
+	if command == "config" {
+		exitOnError(configCommand(*configPath, flag.Arg(1)))
+		os.Exit(0)
+	}
+	configuration, err := readConfig(*configPath)
+	exitOnError(err)
+	sites, err := configuration.selectSites(*site)
+	exitOnError(err)
+	var sessions []*session
+	for _, siteConfiguration := range sites {
+		sessions = append(sessions, &session{configuration: siteConfiguration, copyHugoSiteScript: copyHugoSiteScript})
+	}
+	// Commands that do not touch the state run without the lock
+	switch command {
+	case "status":
+		for _, s := range sessions {
+			s.printHeader(len(sessions))
+			exitOnError(showStatus(s, lockPath))
+		}
+		os.Exit(0)
+	case "convert":
+		if flag.NArg() > 1 {
+			if len(sessions) > 1 {
+				exitOnError(fmt.Errorf("pick the site to convert for with --site"))
+			}
+			exitOnError(convertSingleDocument(sessions[0], flag.Arg(1), flag.Arg(2), articleOutput))
+			os.Exit(0)
+		}
+		fallthrough
+	case "build", "deploy", "preview", "reset-state":
+		if *dryRun {
+			fmt.Println("[ERROR] --dry-run only works with run and sync")
+			os.Exit(2)
+		}
+	case "daemon":
+		if *dryRun {
+			fmt.Println("[ERROR] --dry-run only works with run and sync")
+			os.Exit(2)
+		}
+	case "run", "sync":
+	default:
+		fmt.Println("[ERROR] Unknown command " + command)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if command == "daemon" {
+		runDaemon(sessions, lockPath, *interval)
+	}
+	if *dryRun {
+		command = "dry-run"
+	}
+	failed, err := runSessions(sessions, command, lockPath, *wait)
+	if _, locked := err.(lockedError); locked {
+		fmt.Println(err)
+		os.Exit(exitLocked)
+	}
+	if err != nil {
+		fmt.Println("[ERROR] Error taking the run lock: ", err)
+		os.Exit(1)
+	}
+	if len(failed) > 0 {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Run a command on every site under the run lock, returning the sites that failed
+func runSessions(sessions []*session, command string, lockPath string, wait bool) ([]string, error) {
+	// Keep runs from overlapping
+	lock, err := acquireRunLock(lockPath, wait)
+	if err != nil {
+		return nil, err
+	}
+	// A site that fails does not stop the others
+	var failed []string
+	for _, s := range sessions {
+		s.lock = lock
+		s.printHeader(len(sessions))
+		err = runCommand(s, command)
+		if err != nil {
+			fmt.Println("[ERROR] ", err)
+			failed = append(failed, s.name())
+		}
+	}
+	lock.Release()
+	if len(failed) > 0 && len(sessions) > 1 {
+		fmt.Println("[ERROR] Failed sites: " + strings.Join(failed, ", "))
+	}
+	return failed, nil
+}
+
+// Keep running the pipeline every interval, and as soon as a scheduled article's publish date
+// arrives so embargoed stories go up on time. Runs from a timer wait for each other through the lock.
+func runDaemon(sessions []*session, lockPath string, interval time.Duration) {
+	for {
+		_, err := runSessions(sessions, "run", lockPath, true)
+		if err != nil {
+			fmt.Println("[ERROR] Error taking the run lock: ", err)
+		}
+		now := time.Now()
+		next := now.Add(interval)
+		for _, s := range sessions {
+			if s.manifest == nil {
+				continue
+			}
+			if scheduled, found := s.manifest.nextScheduled(now); found && scheduled.Before(next) {
+				next = scheduled
+			}
+		}
+		fmt.Println("Next run at " + next.Format(time.RFC1123))
+		time.Sleep(next.Sub(time.Now()))
+	}
+}
+
+// Run a command that takes the lock on a site
+func runCommand(s *session, command string) error {
+	switch command {
+	case "dry-run":
+		err := s.openManifest()
+		if err != nil {
+			return err
+		}
+		return runDryRun(s)
+	case "run":
+		err := s.openManifest()
+		if err != nil {
+			return err
+		}
+		return runPipeline(s)
+	case "sync":
+		err := s.openManifest()
+		if err != nil {
+			return err
+		}
+		return runSync(s)
+	case "convert":
+		err := s.openManifest()
+		if err != nil {
+			return err
+		}
+		return runConvert(s)
+	case "build":
+		return runBuild(s)
+	case "deploy":
+		return runDeploy(s)
+	case "preview":
+		return runPreview(s)
+	case "reset-state":
+		return resetState(s.configuration.HashtablePath)
+	}
+	return fmt.Errorf("unknown command %s", command)
+}
+
+// The site's name, or the configuration's when there are no site profiles
+func (s *session) name() string {
+	if s.configuration.Name == "" {
+		return "default"
+	}
+	return s.configuration.Name
+}
+
+// Tell the sites apart in the output when there are several
+func (s *session) printHeader(sites int) {
+	if sites > 1 {
+		fmt.Println("== Site " + s.name() + " ==")
+	}
+}
+
+// Record the stage of the pipeline in the lock file along with the site
+func (s *session) setPhase(phase string) {
+	if s.configuration.Name != "" {
+		phase = s.configuration.Name + ": " + phase
+	}
+	s.lock.SetPhase(phase)
+}
+
+func exitOnError(err error) {
+	if err != nil {
+		fmt.Println("[ERROR] ", err)
+		os.Exit(1)
+	}
+}
+
+// Check the state file and read the manifest
+func (s *session) openManifest() error {
+	hashtablePath := s.configuration.HashtablePath
+	err := recoverState(hashtablePath)
+	if err != nil {
+		return err
+	}
+	s.manifest, err = readManifest(hashtablePath)
+	if err != nil {
+		return fmt.Errorf("reading the manifest: %v", err)
+	}
+	return nil
+}
+
+func (s *session) saveManifest() error {
+	s.setPhase("saving state")
+	err := s.manifest.Save(s.configuration.HashtablePath)
+	if err != nil {
+		return fmt.Errorf("saving the manifest: %v", err)
+	}
+	return nil
+}
+
+// Sync, convert, build and deploy, saving the state after each stage so a failed stage
+// picks up where it left off on the next run
+func runPipeline(s *session) error {
+	err := runSync(s)
+	if err != nil {
+		return err
+	}
+	s.setPhase("converting")
+	converting := time.Now()
+	changed := applyPendingChanges(s.manifest, s.configuration)
+	err = s.saveManifest()
+	if err != nil {
+		return err
+	}
+	// Serve the website by compiling the site with hugo and moving it to the production directory,
+	// unless no article changed since the last build
+	if !changed && len(s.manifest.unbuilt()) == 0 {
+		fmt.Println("No articles changed, skipping the hugo build")
+	} else {
+		s.setPhase("building")
+		serveMessage := make(chan error, 1)
+		var serveWebsite sync.WaitGroup
+		serveWebsite.Add(1)
+		go compileAndServeHugoSite(s.configuration.HugoPostDirectory, s.configuration.ProductionDirectory, s.copyHugoSiteScript, &serveWebsite, serveMessage)
+		serveWebsite.Wait()
+		err = <-serveMessage
+		if err != nil {
+			return err
+		}
+		s.manifest.markBuilt(time.Now())
+		err = s.saveManifest()
+		if err != nil {
+			return err
+		}
+		// The preview has every article, drafts included, for editors to check before publishing
+		if previewEnabled(s.configuration) {
+			err = runPreview(s)
+			if err != nil {
+				return err
+			}
+			for _, id := range s.manifest.sortedIDs() {
+				if entry := s.manifest.Documents[id]; entry.Converted.After(converting) && entry.PreviewURL != "" {
+					fmt.Println("Preview " + entry.SourcePath + " at " + entry.PreviewURL)
+				}
+			}
+		}
+	}
+	// Send back a success message and code
+	fmt.Println("driveraker successfully synced, converted, and compiled Google Documents into a website")
+	fmt.Println("Thanks to other open source projects like:")
+	fmt.Println("* Emmanuel Odeke's drive command line client for Google Drive")
+	fmt.Println("* John MacFarlane's pandoc file converter")
+	fmt.Println("* And many more...")
+	return nil
+}
+
+// Sync the source and record the changes in the manifest without converting anything
+func runSync(s *session) error {
+	source, err := newSource(s.configuration, false)
+	if err != nil {
+		return fmt.Errorf("setting up the source: %v", err)
+	}
+	s.setPhase("syncing")
+	syncMessage := make(chan error, 1)
+	var driveSync sync.WaitGroup
+	driveSync.Add(1)
+	go syncGoogleDrive(source, s.manifest, s.configuration, &driveSync, syncMessage)
+	driveSync.Wait()
+	err = <-syncMessage
+	if err != nil {
+		return fmt.Errorf("syncing: %v", err)
+	}
+	err = s.saveManifest()
+	if err != nil {
+		return err
+	}
+	err = source.SaveState()
+	if err != nil {
+		return fmt.Errorf("saving the source state: %v", err)
+	}
+	for _, article := range s.manifest.PendingArticles() {
+		fmt.Println("To convert: " + article.Document.ExportPath)
+	}
+	for _, article := range s.manifest.PendingDeletions() {
+		fmt.Println("To unpublish: " + article.Document.Path)
+	}
+	return nil
+}
+
+// Convert what the last sync left pending
+func runConvert(s *session) error {
+	s.setPhase("converting")
+	applyPendingChanges(s.manifest, s.configuration)
+	return s.saveManifest()
+}
+
+// Compile the hugo site without deploying it. The articles are left to build, so the next run
+// still builds and deploys them.
+func runBuild(s *session) error {
+	s.setPhase("building")
+	return compileHugoSite(s.configuration.HugoPostDirectory)
+}
+
+// Copy the last build to the production directory
+func runDeploy(s *session) error {
+	s.setPhase("deploying")
+	return publishHugoSite(s.configuration.HugoPostDirectory, s.configuration.ProductionDirectory, s.copyHugoSiteScript)
+}
+
+// Convert one docx file outside of the manifest, for checking how a document comes out.
+// Without a markdown path the article is written to output.
+func convertSingleDocument(s *session, docxFilePath string, markdownPath string, output io.Writer) error {
+	toStdout := markdownPath == ""
+	if toStdout {
+		f, err := ioutil.TempFile("", "driveraker-*.md")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		markdownPath = f.Name()
+		defer os.Remove(markdownPath)
+	}
+	err := convertDocument(docxFilePath, markdownPath, s.configuration)
+	if err != nil || !toStdout {
+		return err
+	}
+	contents, err := ioutil.ReadFile(markdownPath)
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(contents)
+	return err
+}
+
+// Show who holds the lock and what is waiting in the manifest
+func showStatus(s *session, lockPath string) error {
+	info, held, err := readLockStatus(lockPath)
+	if err != nil {
+		return fmt.Errorf("reading the lock: %v", err)
+	}
+	if held {
+		fmt.Println("Run in progress: " + info.String())
+	} else {
+		fmt.Println("No run in progress")
+	}
+	manifest, err := readManifest(s.configuration.HashtablePath)
+	if err != nil {
+		return fmt.Errorf("reading the manifest: %v", err)
+	}
+	fmt.Println("Source: " + s.configuration.Source)
+	fmt.Println("Cursor: " + manifest.Cursor)
+	fmt.Printf("Documents: %d\n", len(manifest.Documents))
+	now := time.Now()
+	for _, id := range manifest.sortedIDs() {
+		entry := manifest.Documents[id]
+		state := "published"
+		switch {
+		case entry.Deleted:
+			state = "to unpublish"
+		case entry.Unfetched != nil:
+			state = "to fetch"
+		case entry.Pending() && entry.LastError != "":
+			state = "failed"
+		case entry.Pending():
+			state = "to convert"
+		case entry.Unbuilt():
+			state = "to build"
+		case entry.ContentSHA256 == "":
+			state = "not converted"
+		case entry.Unpublished():
+			state = entry.Status
+		case entry.Scheduled(now):
+			state = "scheduled"
+		}
+		fmt.Printf("  %-14s %s -> %s\n", state, entry.SourcePath, entry.MarkdownPath)
+		if state == "failed" {
+			fmt.Printf("  %-14s %s\n", "", entry.LastError)
+		}
+		if state == "to fetch" {
+			fmt.Printf("  %-14s %s\n", "", entry.FetchError)
+		}
+		if entry.PreviewURL != "" && (entry.Unpublished() || entry.Scheduled(now)) {
+			fmt.Printf("  %-14s preview at %s\n", "", entry.PreviewURL)
+		}
+	}
+	scheduled := manifest.scheduled(now)
+	if len(scheduled) > 0 {
+		fmt.Println("Scheduled:")
+	}
+	for _, id := range scheduled {
+		entry := manifest.Documents[id]
+		fmt.Printf("  %s %s\n", entry.PublishDate.Local().Format(time.RFC1123), entry.SourcePath)
+	}
+	return nil
+}
+
+// Check the configuration or show the settings in effect, without doing anything else
+func configCommand(configPath string, subcommand string) error {
+	if subcommand != "validate" && subcommand != "show" {
+		return fmt.Errorf("unknown config command %q, try config validate or config show", subcommand)
+	}
+	configuration, err := readConfig(configPath)
+	if err != nil {
+		return err
+	}
+	// Keep the secrets out of terminals and logs, and with site profiles show each
+	// site's settings rather than the shared ones they were made from
+	var effective interface{} = configuration.redacted()
+	if len(configuration.Sites) > 0 {
+		effective = configuration.redacted().Sites
+	}
+	settings, err := json.MarshalIndent(effective, "", "    ")
+	if err != nil {
+		return err
+	}
+	if subcommand == "validate" {
+		fmt.Println("The configuration at " + configPath + " is valid, the settings in effect are:")
+	}
+	fmt.Println(string(settings))
+	return nil
+}
+
+// Move the manifest aside and remove the source indexes so the next sync starts from scratch
+func resetState(hashtablePath string) error {
+	err := os.Rename(hashtablePath, hashtablePath+".bak")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		fmt.Println("Moved the manifest to " + hashtablePath + ".bak")
+	}
+	for _, suffix := range []string{".drive", ".local"} {
+		err = os.Remove(hashtablePath + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The configuration file struct
+type Configuration struct {
+	DriveSyncDirectory         string
+	GoogleDriveRemoteDirectory string
+	HugoPostDirectory          string
+	ProductionDirectory        string
+	// Where driveraker keeps its manifest of synced documents
+	HashtablePath string
+	// Where documents come from: "drive" (the default) for the drive CLI, "api" for the
+	// Drive v3 API, or "local" for a directory of docx files in DriveSyncDirectory.
+	// The drive CLI does not track renames: a renamed document is a new article and the old one
+	// is taken down, without an alias from its old URL. Use the API source to keep old URLs working.
+	Source string
+	// Settings for the Drive v3 API source
+	DriveAPIFolderID     string
+	DriveAPIClientID     string
+	DriveAPIClientSecret string
+	DriveAPIRefreshToken string
+	// Override the Google endpoints, e.g. to point at a stand-in server
+	DriveAPIEndpoint string
+	DriveAPITokenURL string
+	// What happens to the article of a document deleted from the source:
+	// "archive" (the default) moves it and its images to ArchiveDirectory,
+	// "delete" removes them and "draft" keeps them but marks the article a draft
+	DeletionPolicy string
+	// Defaults to the archive directory inside HugoPostDirectory
+	ArchiveDirectory string
+	// The hugo content section articles go in, "articles" by default
+	Section string
+	// Sections for documents in particular folders of the source, e.g. "Opinion/Columns/": "opinion".
+	// The longest matching folder wins, documents in no listed folder go in Section.
+	Sections map[string]string `json:",omitempty"`
+	// "file" (the default) writes articles as content/<section>/<slug>.md,
+	// "bundle" as hugo page bundles in content/<section>/<slug>/index.md
+	ArticleLayout string
+	// How documents become markdown: "pandoc" (the default) runs /usr/bin/pandoc, "native" reads the docx itself
+	Converter string
+	// Options added to pandoc's, e.g. ["--wrap=none"], and Lua filters it runs, which need pandoc 2.0 or later
+	PandocArguments  []string `json:",omitempty"`
+	PandocLuaFilters []string `json:",omitempty"`
+	// The front matter format of generated articles: "json" (the default), "toml" or "yaml"
+	FrontMatterFormat string
+	// A JSON, TOML or YAML file of static front matter keys per section, with "*" for every section
+	FrontMatterTemplate string
+	// The workflow status of documents in particular folders of the source, e.g. "Drafts/": "draft".
+	// "draft" and "review" keep articles off the site, documents in no listed folder are "published".
+	StatusFolders map[string]string `json:",omitempty"`
+	// The IANA time zone of dates written without one, e.g. "America/Los_Angeles", the machine's by default
+	TimeZone string
+	// Custom keys of the document metadata block and the front matter keys they become,
+	// e.g. "SERIES": "series" for DRVRKR_SERIES. Other unknown keys are reported.
+	MetadataKeys map[string]string `json:",omitempty"`
+	// A second build with drafts and future articles included, copied to PreviewDirectory
+	// and served at PreviewBaseURL, so editors see an article before it is published
+	PreviewDirectory string
+	PreviewBaseURL   string
+	// Widths in pixels of the copies of each image for the browser to choose from, e.g. [480, 960, 1600].
+	// The widest is the widest an image is published at, an empty list keeps images at their own width.
+	// Photos are recompressed at the JPEG ImageQuality, 85 by default.
+	ImageWidths  []int `json:",omitempty"`
+	ImageQuality int   `json:",omitempty"`
+	// Site profiles, each feeding its own hugo site from its own source folder.
+	// A site takes the settings above for anything it leaves out, and needs a
+	// Name and a HashtablePath of its own.
+	Sites []Configuration `json:",omitempty"`
+	Name  string          `json:",omitempty"`
+}
+
+// Everything wrong with a configuration, so it can be fixed in one go
+type configErrors []string
+
+func (errs configErrors) Error() string {
+	return "invalid configuration:\n  * " + strings.Join(errs, "\n  * ")
+}
+
+func (errs *configErrors) add(format string, a ...interface{}) {
+	*errs = append(*errs, fmt.Sprintf(format, a...))
+}
+
+// Read the configuration file, JSON unless it ends in .toml, .yaml or .yml,
+// apply the environment overrides, fill in the defaults and check it
+func readConfig(filename string) (Configuration, error) {
+	fmt.Println("Reading configuration...")
+	configuration := Configuration{}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return configuration, fmt.Errorf("reading the configuration: %v", err)
+	}
+	contents, err = configJSON(filename, contents)
+	if err != nil {
+		return configuration, err
+	}
+	// Unknown keys are found up front since a strict decoder stops at the first one
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(contents, &fields)
+	if err != nil {
+		return configuration, fmt.Errorf("reading the JSON configuration %s: %v", filename, jsonErrorPosition(contents, err))
+	}
+	var errs configErrors
+	for _, key := range unknownConfigKeys(fields) {
+		errs.add("unknown setting %q", key)
+	}
+	var sites []map[string]json.RawMessage
+	if json.Unmarshal(fields["Sites"], &sites) == nil {
+		for i, site := range sites {
+			for _, key := range unknownConfigKeys(site) {
+				errs.add("site %d: unknown setting %q", i+1, key)
+			}
+		}
+	}
+	err = json.Unmarshal(contents, &configuration)
+	if err != nil {
+		errs.add("%v", jsonErrorPosition(contents, err))
+	}
+	errs = append(errs, configuration.applyEnvironment(os.Environ())...)
+	errs = append(errs, configuration.resolveSites()...)
+	if len(errs) > 0 {
+		return configuration, errs
+	}
+	fmt.Println("Finished reading configuration!")
+	return configuration, nil
+}
+
+// Setting names the configuration file may use, in the order Configuration declares them
+func configKeys() []string {
+	var keys []string
+	configurationType := reflect.TypeOf(Configuration{})
+	for i := 0; i < configurationType.NumField(); i++ {
+		keys = append(keys, configurationType.Field(i).Name)
+	}
+	return keys
+}
+
+// Turn the shared settings and the site profiles into a complete configuration per site,
+// with the defaults filled in and each site checked. Without profiles the settings are the one site.
+func (configuration *Configuration) resolveSites() (errs configErrors) {
+	if len(configuration.Sites) == 0 {
+		configuration.applyDefaults()
+		if validationErrs, invalid := configuration.validate().(configErrors); invalid {
+			errs = append(errs, validationErrs...)
+		}
+		return errs
+	}
+	shared := reflect.ValueOf(*configuration)
+	names := make(map[string]bool)
+	statePaths := make(map[string]string)
+	for i := range configuration.Sites {
+		site := &configuration.Sites[i]
+		label := fmt.Sprintf("site %d", i+1)
+		if site.Name != "" {
+			label = fmt.Sprintf("site %q", site.Name)
+		}
+		if len(site.Sites) > 0 {
+			errs.add("%s: sites cannot have sites of their own", label)
+		}
+		if site.Name == "" {
+			errs.add("%s: Name is missing", label)
+		} else if names[site.Name] {
+			errs.add("%s: another site has the same Name", label)
+		}
+		names[site.Name] = true
+		if site.HashtablePath == "" {
+			errs.add("%s: HashtablePath is missing, every site keeps its own state", label)
+		}
+		// Settings the site leaves out come from the shared ones, an empty list or table set on purpose stays
+		fields := reflect.ValueOf(site).Elem()
+		for _, key := range configKeys() {
+			if key != "Name" && key != "Sites" && fields.FieldByName(key).IsZero() {
+				fields.FieldByName(key).Set(shared.FieldByName(key))
+			}
+		}
+		site.applyDefaults()
+		if validationErrs, invalid := site.validate().(configErrors); invalid {
+			for _, validationErr := range validationErrs {
+				errs.add("%s: %s", label, validationErr)
+			}
+		}
+		if other, shared := statePaths[site.HashtablePath]; shared && site.HashtablePath != "" {
+			errs.add("%s: HashtablePath is the same as %s's", label, other)
+		}
+		statePaths[site.HashtablePath] = label
+	}
+	return errs
+}
+
+// The sites to run, only the named one when name is not empty
+func (configuration Configuration) selectSites(name string) ([]Configuration, error) {
+	sites := configuration.Sites
+	if len(sites) == 0 {
+		sites = []Configuration{configuration}
+	}
+	if name == "" {
+		return sites, nil
+	}
+	for _, site := range sites {
+		if site.Name == name {
+			return []Configuration{site}, nil
+		}
+	}
+	return nil, fmt.Errorf("there is no site named %q in the configuration", name)
+}
+
+func unknownConfigKeys(fields map[string]json.RawMessage) (unknown []string) {
+	known := make(map[string]bool)
+	for _, key := range configKeys() {
+		// encoding/json matches keys case insensitively
+		known[strings.ToLower(key)] = true
+	}
+	for key := range fields {
+		if !known[strings.ToLower(key)] {
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// Point at the line and column encoding/json only gives as a byte offset
+func jsonErrorPosition(contents []byte, err error) error {
+	var offset int64
+	switch jsonErr := err.(type) {
+	case *json.SyntaxError:
+		offset = jsonErr.Offset
+	case *json.UnmarshalTypeError:
+		offset = jsonErr.Offset
+		err = fmt.Errorf("%s must be a %s, not a %s", jsonErr.Field, jsonErr.Type, jsonErr.Value)
+	default:
+		return err
+	}
+	if offset > int64(len(contents)) {
+		offset = int64(len(contents))
+	}
+	line := 1 + bytes.Count(contents[:offset], []byte("\n"))
+	column := offset - int64(bytes.LastIndexByte(contents[:offset], '\n'))
+	return fmt.Errorf("line %d, column %d: %v", line, column, err)
+}
+
+// Fill in the optional settings and make sure directories end in a slash,
+// paths inside them are built by concatenation
+func (configuration *Configuration) applyDefaults() {
+	if configuration.Source == "" {
+		configuration.Source = "drive"
+	}
+	if configuration.DeletionPolicy == "" {
+		configuration.DeletionPolicy = "archive"
+	}
+	if configuration.Section == "" {
+		configuration.Section = "articles"
+	}
+	if configuration.ArticleLayout == "" {
+		configuration.ArticleLayout = "file"
+	}
+	if configuration.Converter == "" {
+		configuration.Converter = "pandoc"
+	}
+	if configuration.FrontMatterFormat == "" {
+		configuration.FrontMatterFormat = "json"
+	}
+	if configuration.ImageWidths == nil {
+		configuration.ImageWidths = defaultImageWidths
+	}
+	if configuration.ImageQuality == 0 {
+		configuration.ImageQuality = defaultImageQuality
+	}
+	if configuration.Source == "api" {
+		if configuration.DriveAPIEndpoint == "" {
+			configuration.DriveAPIEndpoint = "https://www.googleapis.com"
+		}
+		if configuration.DriveAPITokenURL == "" {
+			configuration.DriveAPITokenURL = "https://oauth2.googleapis.com/token"
+		}
+	}
+	for _, directory := range []*string{&configuration.DriveSyncDirectory, &configuration.HugoPostDirectory, &configuration.ProductionDirectory, &configuration.ArchiveDirectory, &configuration.PreviewDirectory} {
+		if *directory != "" && !strings.HasSuffix(*directory, "/") {
+			*directory += "/"
+		}
+	}
+	if configuration.ArchiveDirectory == "" && configuration.HugoPostDirectory != "" {
+		configuration.ArchiveDirectory = configuration.HugoPostDirectory + "archive/"
+	}
+}
+
+// Check the settings make sense and the directories driveraker writes to are there and writable
+func (configuration *Configuration) validate() error {
+	var errs configErrors
+	required := map[string]string{
+		"DriveSyncDirectory":  configuration.DriveSyncDirectory,
+		"HugoPostDirectory":   configuration.HugoPostDirectory,
+		"ProductionDirectory": configuration.ProductionDirectory,
+		"HashtablePath":       configuration.HashtablePath,
+	}
+	switch configuration.Source {
+	case "drive", "local":
+	case "api":
+		required["DriveAPIFolderID"] = configuration.DriveAPIFolderID
+		required["DriveAPIClientID"] = configuration.DriveAPIClientID
+		required["DriveAPIClientSecret"] = configuration.DriveAPIClientSecret
+		required["DriveAPIRefreshToken"] = configuration.DriveAPIRefreshToken
+	default:
+		errs.add("Source is %q, it must be \"drive\", \"api\" or \"local\"", configuration.Source)
+	}
+	switch configuration.DeletionPolicy {
+	case "archive", "delete", "draft":
+	default:
+		errs.add("DeletionPolicy is %q, it must be \"archive\", \"delete\" or \"draft\"", configuration.DeletionPolicy)
+	}
+	if !validSection(configuration.Section) {
+		errs.add("Section is %q, it must be a directory inside the hugo content directory", configuration.Section)
+	}
+	var folders []string
+	for folder := range configuration.Sections {
+		folders = append(folders, folder)
+	}
+	sort.Strings(folders)
+	for _, folder := range folders {
+		if strings.Trim(folder, "/") == "" {
+			errs.add("Sections: a folder is empty, use Section for documents outside the listed folders")
+		}
+		if section := configuration.Sections[folder]; !validSection(section) {
+			errs.add("Sections: %q maps to %q, it must be a directory inside the hugo content directory", folder, section)
+		}
+	}
+	switch configuration.Converter {
+	case "pandoc", "native":
+	default:
+		errs.add("Converter is %q, it must be \"pandoc\" or \"native\"", configuration.Converter)
+	}
+	for _, filter := range configuration.PandocLuaFilters {
+		if _, err := os.Stat(filter); err != nil {
+			errs.add("PandocLuaFilters: %v", err)
+		}
+	}
+	for _, width := range configuration.ImageWidths {
+		if width <= 0 {
+			errs.add("ImageWidths: %d is not a width, they are in pixels", width)
+		}
+	}
+	if configuration.ImageQuality < 1 || configuration.ImageQuality > 100 {
+		errs.add("ImageQuality is %d, it must be from 1 to 100", configuration.ImageQuality)
+	}
+	switch configuration.FrontMatterFormat {
+	case "json", "toml", "yaml":
+	default:
+		errs.add("FrontMatterFormat is %q, it must be \"json\", \"toml\" or \"yaml\"", configuration.FrontMatterFormat)
+	}
+	if configuration.FrontMatterTemplate != "" {
+		if _, err := frontMatterParams(configuration.FrontMatterTemplate, configuration.Section); err != nil {
+			errs.add("FrontMatterTemplate: %v", err)
+		}
+	}
+	errs = append(errs, validateStatusFolders(configuration.StatusFolders)...)
+	errs = append(errs, validateMetadataKeys(configuration.MetadataKeys)...)
+	if _, err := time.LoadLocation(configuration.TimeZone); err != nil {
+		errs.add("TimeZone %q is not a time zone, use a name like \"Europe/Berlin\" or \"UTC\"", configuration.TimeZone)
+	}
+	if configuration.PreviewDirectory != "" || configuration.PreviewBaseURL != "" {
+		required["PreviewDirectory"] = configuration.PreviewDirectory
+		required["PreviewBaseURL"] = configuration.PreviewBaseURL
+	}
+	if configuration.PreviewBaseURL != "" && !strings.HasPrefix(configuration.PreviewBaseURL, "http://") && !strings.HasPrefix(configuration.PreviewBaseURL, "https://") {
+		errs.add("PreviewBaseURL is %q, it must be an http:// or https:// URL", configuration.PreviewBaseURL)
+	}
+	switch configuration.ArticleLayout {
+	case "file", "bundle":
+	default:
+		errs.add("ArticleLayout is %q, it must be \"file\" or \"bundle\"", configuration.ArticleLayout)
+	}
+	for _, key := range configKeys() {
+		if value, isRequired := required[key]; isRequired && value == "" {
+			errs.add("%s is missing", key)
+		}
+	}
+	writableDirectories := []struct {
+		Key       string
+		Directory string
+	}{
+		{"DriveSyncDirectory", configuration.DriveSyncDirectory},
+		{"HugoPostDirectory", configuration.HugoPostDirectory},
+		{"ProductionDirectory", configuration.ProductionDirectory},
+		{"PreviewDirectory", configuration.PreviewDirectory},
+		{"HashtablePath", filepath.Dir(configuration.HashtablePath)},
+	}
+	for _, writable := range writableDirectories {
+		if writable.Directory == "" || writable.Key == "HashtablePath" && configuration.HashtablePath == "" {
+			continue
+		}
+		err := checkWritableDirectory(writable.Directory)
+		if err != nil {
+			errs.add("%s: %v", writable.Key, err)
+		}
+	}
+	if configuration.HashtablePath != "" {
+		if info, err := os.Stat(configuration.HashtablePath); err == nil && info.IsDir() {
+			errs.add("HashtablePath: %s is a directory, it must be a file", configuration.HashtablePath)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Sections are directories inside content/, possibly nested like news/local
+func validSection(section string) bool {
+	return section != "" && strings.Trim(section, "/") == section && !strings.Contains(section, "..") && !strings.Contains(section, "//")
+}
+
+// Check a directory exists and we can create files in it by creating one
+func checkWritableDirectory(directory string) error {
+	info, err := os.Stat(directory)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s does not exist", directory)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", directory)
+	}
+	f, err := ioutil.TempFile(directory, atomicTempPrefix+"check-")
+	if err != nil {
+		return fmt.Errorf("%s is not writable", directory)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
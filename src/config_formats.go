@@ -0,0 +1,579 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Environment variables override settings, e.g. DRIVERAKER_HUGO_POST_DIRECTORY for HugoPostDirectory
+const environmentPrefix = "DRIVERAKER_"
+
+// Names the configuration path rather than a setting
+const configPathVariable = environmentPrefix + "CONFIG"
+
+// TOML and YAML configurations only need a small part of either language: string
+// settings, lists of strings, tables of strings like Sections and the list of site profiles.
+// Turn them into JSON so one decoder handles every format.
+func configJSON(filename string, contents []byte) ([]byte, error) {
+	var settings map[string]interface{}
+	var err error
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".toml":
+		settings, err = parseTOMLConfig(string(contents))
+	case ".yaml", ".yml":
+		settings, err = parseYAMLConfig(string(contents))
+	default:
+		return contents, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", filename, err)
+	}
+	return json.Marshal(settings)
+}
+
+// Read `Key = "value"` pairs, [Table] headers and [[Array]] headers for arrays of tables.
+// Dotted headers such as [Sites.Sections] refer to the last table of an array.
+// Values may be inline tables, and arrays may go on over several lines.
+func parseTOMLConfig(contents string) (map[string]interface{}, error) {
+	root := make(map[string]interface{})
+	current := root
+	lines := strings.Split(contents, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(stripComment(lines[i]))
+		if line == "" {
+			continue
+		}
+		line, i = joinOpenBrackets(lines, line, i)
+		if strings.HasPrefix(line, "[") {
+			isArray := strings.HasPrefix(line, "[[")
+			name := strings.TrimSpace(strings.Trim(line, "[]"))
+			table, err := tomlTable(root, name, isArray)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			current = table
+			continue
+		}
+		separator := strings.Index(line, "=")
+		if separator < 0 {
+			return nil, fmt.Errorf("line %d: expected key = \"value\"", i+1)
+		}
+		key, err := unquoteConfigKey(strings.TrimSpace(line[:separator]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		value, err := parseConfigScalar(strings.TrimSpace(line[separator+1:]), false)
+		if err == nil && current[key] != nil {
+			err = fmt.Errorf("%s is set twice", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		current[key] = value
+	}
+	return root, nil
+}
+
+// Find or make the table a TOML header names
+func tomlTable(root map[string]interface{}, name string, isArray bool) (map[string]interface{}, error) {
+	parts := strings.Split(name, ".")
+	table := root
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		last := i == len(parts)-1
+		switch value := table[part].(type) {
+		case nil:
+			if last && isArray {
+				next := make(map[string]interface{})
+				table[part] = []interface{}{next}
+				return next, nil
+			}
+			next := make(map[string]interface{})
+			table[part] = next
+			table = next
+		case []interface{}:
+			if last && isArray {
+				next := make(map[string]interface{})
+				table[part] = append(value, next)
+				return next, nil
+			}
+			table = value[len(value)-1].(map[string]interface{})
+		case map[string]interface{}:
+			if last {
+				return nil, fmt.Errorf("[%s] is defined twice", name)
+			}
+			table = value
+		default:
+			return nil, fmt.Errorf("%s is already a setting", part)
+		}
+	}
+	return table, nil
+}
+
+type yamlLine struct {
+	Number  int
+	Indent  int
+	Content string
+}
+
+// Read block mappings of `Key: value` pairs, nested by indentation, block sequences
+// of mappings such as the list of site profiles, and flow sequences and mappings
+func parseYAMLConfig(contents string) (map[string]interface{}, error) {
+	var lines []yamlLine
+	rawLines := strings.Split(contents, "\n")
+	for i := 0; i < len(rawLines); i++ {
+		line := strings.TrimRight(stripComment(rawLines[i]), " \t\r")
+		content := strings.TrimLeft(line, " ")
+		if content == "" || content == "---" {
+			continue
+		}
+		number := i + 1
+		// Flow sequences and mappings may go on over several lines
+		if joined, last := joinOpenBrackets(rawLines, content, i); last != i {
+			line, content, i = line[:len(line)-len(content)]+joined, joined, last
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: indent with spaces, YAML does not allow tabs", number)
+		}
+		lines = append(lines, yamlLine{number, len(line) - len(content), content})
+	}
+	parser := &yamlParser{lines: lines}
+	if len(lines) == 0 {
+		return make(map[string]interface{}), nil
+	}
+	mapping, err := parser.mapping(lines[0].Indent)
+	if err != nil {
+		return nil, err
+	}
+	if parser.position < len(lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[parser.position].Number)
+	}
+	return mapping, nil
+}
+
+type yamlParser struct {
+	lines    []yamlLine
+	position int
+}
+
+// Read the `Key: value` lines at an indentation
+func (parser *yamlParser) mapping(indent int) (map[string]interface{}, error) {
+	mapping := make(map[string]interface{})
+	for parser.position < len(parser.lines) {
+		line := parser.lines[parser.position]
+		if line.Indent < indent || strings.HasPrefix(line.Content, "- ") {
+			break
+		}
+		if line.Indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.Number)
+		}
+		parser.position++
+		separator := strings.Index(line.Content, ":")
+		if separator < 0 {
+			return nil, fmt.Errorf("line %d: expected key: value", line.Number)
+		}
+		key, err := unquoteConfigKey(strings.TrimSpace(line.Content[:separator]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line.Number, err)
+		}
+		if _, duplicate := mapping[key]; duplicate {
+			return nil, fmt.Errorf("line %d: %s is set twice", line.Number, key)
+		}
+		rawValue := strings.TrimSpace(line.Content[separator+1:])
+		if rawValue != "" {
+			mapping[key], err = parseConfigScalar(rawValue, true)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line.Number, err)
+			}
+			continue
+		}
+		// An empty value opens a nested block, or is just empty
+		mapping[key] = ""
+		if parser.position == len(parser.lines) {
+			continue
+		}
+		next := parser.lines[parser.position]
+		switch {
+		case strings.HasPrefix(next.Content, "- ") && next.Indent >= indent:
+			mapping[key], err = parser.sequence(next.Indent)
+		case next.Indent > indent:
+			mapping[key], err = parser.mapping(next.Indent)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mapping, nil
+}
+
+var yamlKeyRegex = regexp.MustCompile(`^[^\s"'\[][^:]*:(\s|$)`)
+
+// Read `- Key: value` items at an indentation, each a mapping, or `- value` items
+func (parser *yamlParser) sequence(indent int) ([]interface{}, error) {
+	var items []interface{}
+	for parser.position < len(parser.lines) {
+		line := parser.lines[parser.position]
+		if line.Indent != indent || !strings.HasPrefix(line.Content, "- ") {
+			break
+		}
+		content := strings.TrimLeft(line.Content[2:], " ")
+		if !yamlKeyRegex.MatchString(content) {
+			parser.position++
+			item, err := parseConfigScalar(content, true)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line.Number, err)
+			}
+			items = append(items, item)
+			continue
+		}
+		// The item's first key lines up with the keys under it
+		parser.lines[parser.position] = yamlLine{line.Number, line.Indent + len(line.Content) - len(content), content}
+		item, err := parser.mapping(parser.lines[parser.position].Indent)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+var numberRegex = regexp.MustCompile(`^[-+]?[0-9]+(\.[0-9]+)?([eE][-+]?[0-9]+)?$`)
+
+// A quoted string, a boolean, a number, an inline list or table of them, or in YAML a plain string
+func parseConfigScalar(value string, yaml bool) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(value, "["):
+		return parseConfigList(value, yaml)
+	case strings.HasPrefix(value, "{"):
+		return parseConfigTable(value, yaml)
+	case strings.HasPrefix(value, `"`):
+		return strconv.Unquote(value)
+	case strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") && len(value) >= 2:
+		if yaml {
+			return strings.Replace(value[1:len(value)-1], "''", "'", -1), nil
+		}
+		return value[1 : len(value)-1], nil
+	case value == "true" || value == "false":
+		return value == "true", nil
+	case numberRegex.MatchString(value):
+		return json.Number(value), nil
+	case yaml && (value == "~" || value == "null"):
+		return "", nil
+	case yaml:
+		return value, nil
+	}
+	return nil, fmt.Errorf("%s is not a string, quote it", value)
+}
+
+// An inline list like ["--wrap=none", "--columns=80"], or [a, b] in YAML
+func parseConfigList(value string, yaml bool) ([]interface{}, error) {
+	if !strings.HasSuffix(value, "]") || bracketDepth(value) != 0 {
+		return nil, fmt.Errorf("%s is missing the closing ]", value)
+	}
+	items := []interface{}{}
+	for _, text := range splitConfigItems(value[1 : len(value)-1]) {
+		item, err := parseConfigScalar(text, yaml)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// An inline table like { "Sports/" = "sports" }, or { Sports/: sports } in YAML
+func parseConfigTable(value string, yaml bool) (map[string]interface{}, error) {
+	if !strings.HasSuffix(value, "}") || bracketDepth(value) != 0 {
+		return nil, fmt.Errorf("%s is missing the closing }", value)
+	}
+	separator := "="
+	if yaml {
+		separator = ":"
+	}
+	table := make(map[string]interface{})
+	for _, pair := range splitConfigItems(value[1 : len(value)-1]) {
+		split := outsideQuotes(pair, func(r rune) bool { return string(r) == separator })
+		if split < 0 {
+			return nil, fmt.Errorf("expected key %s value in %s", separator, value)
+		}
+		key, err := unquoteConfigKey(strings.TrimSpace(pair[:split]))
+		if err != nil {
+			return nil, err
+		}
+		if _, duplicate := table[key]; duplicate {
+			return nil, fmt.Errorf("%s is set twice in %s", key, value)
+		}
+		table[key], err = parseConfigScalar(strings.TrimSpace(pair[split+1:]), yaml)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return table, nil
+}
+
+// The items of an inline list or table split at the commas outside quotes and nested brackets,
+// trimmed, leaving out the empty one a trailing comma makes
+func splitConfigItems(inside string) (items []string) {
+	for {
+		comma := outsideQuotes(inside, func(r rune) bool { return r == ',' })
+		if comma < 0 {
+			break
+		}
+		items = append(items, strings.TrimSpace(inside[:comma]))
+		inside = inside[comma+1:]
+	}
+	if last := strings.TrimSpace(inside); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
+
+// The index of the first rune matching stop outside quotes and nested brackets, or -1.
+// Quotes only open a string where a value can start, so the apostrophe in a plain YAML value is a letter.
+func outsideQuotes(text string, stop func(r rune) bool) int {
+	var quote rune
+	escaped := false
+	depth := 0
+	previous := ' '
+	for i, r := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case (r == '"' || r == '\'') && strings.ContainsRune(" \t=:[{,", previous):
+			quote = r
+		case depth == 0 && stop(r):
+			return i
+		case r == '[' || r == '{':
+			depth++
+		case r == ']' || r == '}':
+			depth--
+		}
+		previous = r
+	}
+	return -1
+}
+
+// How many brackets a value leaves open, outside quotes
+func bracketDepth(text string) int {
+	var quote rune
+	escaped := false
+	depth := 0
+	previous := ' '
+	for _, r := range text {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case (r == '"' || r == '\'') && strings.ContainsRune(" \t=:[{,", previous):
+			quote = r
+		case r == '[' || r == '{':
+			depth++
+		case r == ']' || r == '}':
+			depth--
+		}
+		previous = r
+	}
+	return depth
+}
+
+// Join the lines after line i to it while it leaves a bracket open, returning the joined line
+// and the index of the last line it took
+func joinOpenBrackets(lines []string, line string, i int) (string, int) {
+	for bracketDepth(line) > 0 && i+1 < len(lines) {
+		i++
+		line += " " + strings.TrimSpace(stripComment(lines[i]))
+	}
+	return line, i
+}
+
+// Drop a # comment, which starts a line or follows whitespace, leaving any # inside quotes
+// or inside a value such as a URL fragment alone
+func stripComment(line string) string {
+	previous := ' '
+	var quote rune
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case (r == '"' || r == '\'') && strings.ContainsRune(" \t=:[{,", previous):
+			quote = r
+		case r == '#' && (previous == ' ' || previous == '\t'):
+			return line[:i]
+		}
+		previous = r
+	}
+	return line
+}
+
+func unquoteConfigKey(key string) (string, error) {
+	if strings.HasPrefix(key, `"`) {
+		return strconv.Unquote(key)
+	}
+	if strings.HasPrefix(key, "'") && strings.HasSuffix(key, "'") && len(key) >= 2 {
+		return key[1 : len(key)-1], nil
+	}
+	if key == "" {
+		return "", fmt.Errorf("missing a key")
+	}
+	return key, nil
+}
+
+// The environment variable overriding a setting: HugoPostDirectory becomes
+// DRIVERAKER_HUGO_POST_DIRECTORY and DriveAPIFolderID DRIVERAKER_DRIVE_API_FOLDER_ID
+func environmentVariable(key string) string {
+	runes := []rune(key)
+	var name []rune
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			previousLower := unicode.IsLower(runes[i-1])
+			acronymEnds := unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if previousLower || acronymEnds {
+				name = append(name, '_')
+			}
+		}
+		name = append(name, unicode.ToUpper(r))
+	}
+	return environmentPrefix + string(name)
+}
+
+// Override settings with DRIVERAKER_* environment variables, unknown ones are errors so typos do not go unnoticed.
+// Every setting but Sites has a variable. Lists are comma separated, e.g. DRIVERAKER_IMAGE_WIDTHS=480,960,
+// tables are comma separated key=value pairs, e.g. DRIVERAKER_STATUS_FOLDERS=Drafts/=draft,Review/=review,
+// and a value starting with [ or { is read as JSON for items that hold commas.
+// The variables override the shared settings, site profiles still take precedence over them.
+func (configuration *Configuration) applyEnvironment(environment []string) (errs configErrors) {
+	fields := reflect.ValueOf(configuration).Elem()
+	known := map[string]bool{configPathVariable: true}
+	for _, key := range configKeys() {
+		if key == "Sites" {
+			continue
+		}
+		variable := environmentVariable(key)
+		known[variable] = true
+		for _, pair := range environment {
+			if strings.HasPrefix(pair, variable+"=") {
+				err := setConfigField(fields.FieldByName(key), strings.TrimPrefix(pair, variable+"="))
+				if err != nil {
+					errs.add("%s: %v", variable, err)
+				}
+			}
+		}
+	}
+	var unknown []string
+	for _, pair := range environment {
+		variable := strings.SplitN(pair, "=", 2)[0]
+		if strings.HasPrefix(variable, environmentPrefix) && !known[variable] {
+			unknown = append(unknown, variable)
+		}
+	}
+	sort.Strings(unknown)
+	for _, variable := range unknown {
+		errs.add("unknown environment variable %s", variable)
+	}
+	return errs
+}
+
+// Set a setting from the text of an environment variable
+func setConfigField(field reflect.Value, value string) error {
+	trimmed := strings.TrimSpace(value)
+	if field.Kind() != reflect.String && (strings.HasPrefix(trimmed, "[") || strings.HasPrefix(trimmed, "{")) {
+		parsed := reflect.New(field.Type())
+		err := json.Unmarshal([]byte(trimmed), parsed.Interface())
+		if err != nil {
+			return err
+		}
+		field.Set(parsed.Elem())
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		number, err := strconv.Atoi(trimmed)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		field.SetInt(int64(number))
+	case reflect.Slice:
+		// An empty variable gives an empty list rather than none, e.g. no image widths
+		list := reflect.MakeSlice(field.Type(), 0, 0)
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			element := reflect.New(field.Type().Elem()).Elem()
+			err := setConfigField(element, item)
+			if err != nil {
+				return err
+			}
+			list = reflect.Append(list, element)
+		}
+		field.Set(list)
+	case reflect.Map:
+		table := reflect.MakeMap(field.Type())
+		for _, item := range strings.Split(value, ",") {
+			if strings.TrimSpace(item) == "" {
+				continue
+			}
+			pair := strings.SplitN(item, "=", 2)
+			if len(pair) != 2 {
+				return fmt.Errorf("%q is not a key=value pair", item)
+			}
+			table.SetMapIndex(reflect.ValueOf(strings.TrimSpace(pair[0])), reflect.ValueOf(strings.TrimSpace(pair[1])))
+		}
+		field.Set(table)
+	default:
+		return fmt.Errorf("cannot be set from the environment")
+	}
+	return nil
+}
+
+// The configuration path from the environment, for containers that cannot pass --config
+func defaultConfigPath(home string) string {
+	if configPath := os.Getenv(configPathVariable); configPath != "" {
+		return configPath
+	}
+	return home + "/.config/driveraker/config"
+}
+
+// A copy of the configuration that is safe to print
+func (configuration Configuration) redacted() Configuration {
+	for _, secret := range []*string{&configuration.DriveAPIClientSecret, &configuration.DriveAPIRefreshToken} {
+		if *secret != "" {
+			*secret = "********"
+		}
+	}
+	var sites []Configuration
+	for _, site := range configuration.Sites {
+		sites = append(sites, site.redacted())
+	}
+	configuration.Sites = sites
+	return configuration
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyEnvironmentSetsEverySetting(t *testing.T) {
+	configuration := Configuration{Sections: map[string]string{"Old/": "old"}}
+	errs := configuration.applyEnvironment([]string{
+		"DRIVERAKER_HUGO_POST_DIRECTORY=/srv/hugo/",
+		"DRIVERAKER_IMAGE_QUALITY=70",
+		"DRIVERAKER_IMAGE_WIDTHS=480, 960",
+		"DRIVERAKER_PANDOC_ARGUMENTS=--wrap=none,--columns=80",
+		"DRIVERAKER_PANDOC_LUA_FILTERS=[\"a,b.lua\"]",
+		"DRIVERAKER_SECTIONS=Opinion/Columns/=opinion, Sports/=sports",
+		"DRIVERAKER_STATUS_FOLDERS={\"Drafts, old/\": \"draft\"}",
+		"DRIVERAKER_METADATA_KEYS=SERIES=series",
+		"PATH=/usr/bin",
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	want := Configuration{
+		HugoPostDirectory: "/srv/hugo/",
+		ImageQuality:      70,
+		ImageWidths:       []int{480, 960},
+		PandocArguments:   []string{"--wrap=none", "--columns=80"},
+		PandocLuaFilters:  []string{"a,b.lua"},
+		Sections:          map[string]string{"Opinion/Columns/": "opinion", "Sports/": "sports"},
+		StatusFolders:     map[string]string{"Drafts, old/": "draft"},
+		MetadataKeys:      map[string]string{"SERIES": "series"},
+	}
+	if !reflect.DeepEqual(configuration, want) {
+		t.Errorf("got %+v\nwant %+v", configuration, want)
+	}
+
+	configuration = Configuration{ImageWidths: []int{480}}
+	errs = configuration.applyEnvironment([]string{"DRIVERAKER_IMAGE_WIDTHS="})
+	if len(errs) > 0 || configuration.ImageWidths == nil || len(configuration.ImageWidths) != 0 {
+		t.Errorf("an empty DRIVERAKER_IMAGE_WIDTHS gave %v, %v", configuration.ImageWidths, errs)
+	}
+}
+
+func TestApplyEnvironmentReportsBadValues(t *testing.T) {
+	var configuration Configuration
+	errs := configuration.applyEnvironment([]string{
+		"DRIVERAKER_IMAGE_QUALITY=high",
+		"DRIVERAKER_IMAGE_WIDTHS=480,wide",
+		"DRIVERAKER_SECTIONS=Opinion",
+		"DRIVERAKER_SITES=[]",
+		"DRIVERAKER_HUGO_POST_DIR=/srv/hugo/",
+	})
+	want := []string{
+		"DRIVERAKER_SECTIONS",
+		"DRIVERAKER_IMAGE_WIDTHS",
+		"DRIVERAKER_IMAGE_QUALITY",
+		"unknown environment variable DRIVERAKER_HUGO_POST_DIR",
+		"unknown environment variable DRIVERAKER_SITES",
+	}
+	// Settings come in the order Configuration declares them
+	if len(errs) != len(want) {
+		t.Fatalf("got %q", errs)
+	}
+	for i, err := range errs {
+		if !strings.HasPrefix(err, want[i]) {
+			t.Errorf("error %d is %q, want %s...", i, err, want[i])
+		}
+	}
+}
+
+func TestParseTOMLConfig(t *testing.T) {
+	parsed, err := parseTOMLConfig(`# driveraker settings
+PreviewBaseURL = "https://preview.example.org/#top" # the preview site
+Title = 'say "hi" # not a comment'
+ImageQuality = 80
+ImageWidths = [
+  480,  # phones
+  960,
+]
+PandocArguments = ["--wrap=none", "--columns=80"]
+Sections = { "Sports/" = "sports", "Opinion/Columns/" = "opinion" }
+
+[MetadataKeys]
+"SERIES#" = "series"
+
+[[Sites]]
+Name = "preview"
+StatusFolders = {
+  "Drafts/" = "draft",
+}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"PreviewBaseURL":  "https://preview.example.org/#top",
+		"Title":           `say "hi" # not a comment`,
+		"ImageQuality":    json.Number("80"),
+		"ImageWidths":     []interface{}{json.Number("480"), json.Number("960")},
+		"PandocArguments": []interface{}{"--wrap=none", "--columns=80"},
+		"Sections":        map[string]interface{}{"Sports/": "sports", "Opinion/Columns/": "opinion"},
+		"MetadataKeys":    map[string]interface{}{"SERIES#": "series"},
+		"Sites": []interface{}{
+			map[string]interface{}{"Name": "preview", "StatusFolders": map[string]interface{}{"Drafts/": "draft"}},
+		},
+	}
+	if !reflect.DeepEqual(parsed, want) {
+		t.Errorf("got %#v\nwant %#v", parsed, want)
+	}
+}
+
+func TestParseYAMLConfig(t *testing.T) {
+	parsed, err := parseYAMLConfig(`---
+PreviewBaseURL: https://preview.example.org/#top # the preview site
+Title: Bob's paper
+ImageWidths: [480,
+  960]  # phones and desktops
+Sections: {Sports/: sports, "Opinion/Columns/": opinion}
+MetadataKeys:
+  SERIES: series
+Sites:
+  - Name: preview
+    PandocArguments:
+      - --wrap=none
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"PreviewBaseURL": "https://preview.example.org/#top",
+		"Title":          "Bob's paper",
+		"ImageWidths":    []interface{}{json.Number("480"), json.Number("960")},
+		"Sections":       map[string]interface{}{"Sports/": "sports", "Opinion/Columns/": "opinion"},
+		"MetadataKeys":   map[string]interface{}{"SERIES": "series"},
+		"Sites": []interface{}{
+			map[string]interface{}{"Name": "preview", "PandocArguments": []interface{}{"--wrap=none"}},
+		},
+	}
+	if !reflect.DeepEqual(parsed, want) {
+		t.Errorf("got %#v\nwant %#v", parsed, want)
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	for _, test := range []struct {
+		yaml     bool
+		contents string
+		want     string
+	}{
+		{false, "ImageWidths = [480,\n960\n", "missing the closing ]"},
+		{false, "Sections = { \"Sports/\" = \"sports\"", "missing the closing }"},
+		{false, "Sections = { \"Sports/\" \"sports\" }", "expected key = value"},
+		{false, "Sections = { a = \"b\", a = \"c\" }", "a is set twice"},
+		{false, "Title = Bob", "is not a string, quote it"},
+		{true, "Sections: {Sports/ sports}", "expected key : value"},
+	} {
+		var err error
+		if test.yaml {
+			_, err = parseYAMLConfig(test.contents)
+		} else {
+			_, err = parseTOMLConfig(test.contents)
+		}
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q gave %v, want an error with %q", test.contents, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var pandocPath = "/usr/bin/pandoc"
+
+// Turns an exported docx file into the markdown the front matter stage reads
+type Converter interface {
+	Name() string
+	Convert(docxFilePath string, markdownFilePath string) error
+}
+
+// The converter the configuration asks for, pandoc unless it says "native"
+func newConverter(configuration Configuration) Converter {
+	if configuration.Converter == "native" {
+		return docxConverter{}
+	}
+	return pandocConverter{Arguments: configuration.PandocArguments, LuaFilters: configuration.PandocLuaFilters}
+}
+
+// Runs pandoc with the options of the installed version
+type pandocConverter struct {
+	// Added after driveraker's own options
+	Arguments []string
+	// Paths of Lua filters, which need pandoc 2.0 or later
+	LuaFilters []string
+}
+
+func (pandocConverter) Name() string {
+	return "pandoc"
+}
+
+func (converter pandocConverter) Convert(docxFilePath string, markdownFilePath string) error {
+	version, err := probePandoc()
+	if err != nil {
+		return err
+	}
+	arguments, err := pandocArguments(version, converter.Arguments, converter.LuaFilters)
+	if err != nil {
+		return err
+	}
+	// The embedded images go next to the markdown file for the front matter stage to publish
+	arguments = append(arguments, "--extract-media="+docxMediaDirectory(markdownFilePath))
+	convert := exec.Command(pandocPath, append(arguments, "-o", markdownFilePath, docxFilePath)...)
+	convert.Dir = "/"
+	var stderr bytes.Buffer
+	convert.Stderr = &stderr
+	out, err := convert.Output()
+	if len(out) > 0 {
+		fmt.Println("pandoc: " + string(out))
+	}
+	detail := strings.TrimSpace(stderr.String())
+	if err != nil && detail != "" {
+		return fmt.Errorf("%v: %s", err, detail)
+	}
+	if err != nil {
+		return err
+	}
+	// pandoc warns about things it could not convert without failing
+	if detail != "" {
+		fmt.Println("pandoc: " + detail)
+	}
+	return nil
+}
+
+type pandocVersion struct {
+	Major, Minor, Patch int
+}
+
+func (version pandocVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", version.Major, version.Minor, version.Patch)
+}
+
+func (version pandocVersion) atLeast(major int, minor int, patch int) bool {
+	if version.Major != major {
+		return version.Major > major
+	}
+	if version.Minor != minor {
+		return version.Minor > minor
+	}
+	return version.Patch >= patch
+}
+
+// pandoc is asked for its version until it answers, so a daemon started before pandoc was
+// installed, or while it was being upgraded, picks it up on a later run
+var pandocProbe struct {
+	sync.Mutex
+	found   bool
+	version pandocVersion
+}
+
+func probePandoc() (pandocVersion, error) {
+	pandocProbe.Lock()
+	defer pandocProbe.Unlock()
+	if pandocProbe.found {
+		return pandocProbe.version, nil
+	}
+	out, err := exec.Command(pandocPath, "--version").Output()
+	if err != nil {
+		return pandocVersion{}, fmt.Errorf("running %s --version: %v", pandocPath, err)
+	}
+	version, err := parsePandocVersion(string(out))
+	if err != nil {
+		return pandocVersion{}, err
+	}
+	fmt.Println("Found pandoc " + version.String())
+	pandocProbe.found, pandocProbe.version = true, version
+	return version, nil
+}
+
+var pandocVersionRegex = regexp.MustCompile(`^pandoc(?:\.exe)?\s+(\d+)\.(\d+)(?:\.(\d+))?`)
+
+// Read the version from the first line of pandoc --version, like "pandoc 2.9.2.1"
+func parsePandocVersion(output string) (pandocVersion, error) {
+	match := pandocVersionRegex.FindStringSubmatch(strings.TrimSpace(output))
+	if match == nil {
+		return pandocVersion{}, fmt.Errorf("could not read the pandoc version from %q", strings.SplitN(output, "\n", 2)[0])
+	}
+	var version pandocVersion
+	version.Major, _ = strconv.Atoi(match[1])
+	version.Minor, _ = strconv.Atoi(match[2])
+	version.Patch, _ = strconv.Atoi(match[3])
+	return version, nil
+}
+
+// The options for a pandoc version. pandoc 2.0 dropped --smart for the smart extension and
+// --normalize altogether, 2.11.2 replaced --atx-headers with --markdown-headings and 3.0 removed it.
+func pandocArguments(version pandocVersion, extra []string, luaFilters []string) ([]string, error) {
+	var arguments []string
+	switch {
+	case version.Major < 2:
+		arguments = []string{"--atx-headers", "--smart", "--normalize", "-t", "markdown_strict"}
+	case version.atLeast(2, 11, 2):
+		arguments = []string{"--markdown-headings=atx", "-t", "markdown_strict+smart"}
+	default:
+		arguments = []string{"--atx-headers", "-t", "markdown_strict+smart"}
+	}
+	arguments = append(arguments, "--email-obfuscation=references", "--mathjax")
+	for _, filter := range luaFilters {
+		if version.Major < 2 {
+			return nil, fmt.Errorf("Lua filters need pandoc 2.0 or later, this is pandoc %s", version)
+		}
+		arguments = append(arguments, "--lua-filter="+filter)
+	}
+	return append(arguments, extra...), nil
+}
+
+// Convert a docx file in a batch, sending the error of a document that did not convert on conversionMessage
+func convertToMarkdown(converter Converter, docxFilePath string, markdownFilePath string, conversion *sync.WaitGroup, conversionMessage chan error) {
+	defer conversion.Done()
+	err := converter.Convert(docxFilePath, markdownFilePath)
+	if err == nil {
+		if converted, _ := exists(markdownFilePath); !converted {
+			err = fmt.Errorf("%s did not write %s", converter.Name(), markdownFilePath)
+		}
+	}
+	conversionMessage <- err
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProbePandocRetriesUntilFound(t *testing.T) {
+	previousPath := pandocPath
+	pandocPath = filepath.Join(t.TempDir(), "pandoc")
+	pandocProbe.found = false
+	t.Cleanup(func() {
+		pandocPath = previousPath
+		pandocProbe.found = false
+	})
+	if _, err := probePandoc(); err == nil {
+		t.Fatal("found a pandoc that is not installed")
+	}
+	err := ioutil.WriteFile(pandocPath, []byte("#!/bin/sh\necho 'pandoc 2.19.2'\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := probePandoc()
+	if err != nil || version != (pandocVersion{2, 19, 2}) {
+		t.Fatalf("got %v, %v once pandoc is installed", version, err)
+	}
+	// A found version is kept for the rest of the run
+	os.Remove(pandocPath)
+	if version, err = probePandoc(); err != nil || version != (pandocVersion{2, 19, 2}) {
+		t.Errorf("got %v, %v after the first answer", version, err)
+	}
+}
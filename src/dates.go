@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Dates and times writers put in DRVRKR_PUB_DATE and DRVRKR_UPDATE_DATE, tried in order.
+// Layouts without a time zone are read in the configured TimeZone.
+var documentDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"2006 1 2 15:04",
+	"2006 1 2",
+	"2006/1/2",
+	"January 2, 2006 3:04 PM",
+	"January 2, 2006 15:04",
+	"January 2, 2006",
+	"January 2 2006",
+	"Jan 2, 2006",
+	"Jan 2 2006",
+	"2 January 2006",
+	"2 Jan 2006",
+}
+
+// Read a date or date-time of the metadata block. Impossible dates such as
+// February 30 match no layout, so they are reported rather than published.
+func parseDocumentDate(text string, location *time.Location) (time.Time, error) {
+	text = strings.Join(strings.Fields(strings.Replace(text, `\`, "", -1)), " ")
+	for _, layout := range documentDateLayouts {
+		date, err := time.ParseInLocation(layout, text, location)
+		if err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date, write it like 2017-05-04, 2017-05-04T09:30 or May 4, 2017", text)
+}
+
+// The time zone of dates written without one, the machine's when TimeZone is not set
+func configuredLocation(configuration Configuration) *time.Location {
+	if configuration.TimeZone == "" {
+		return time.Local
+	}
+	location, err := time.LoadLocation(configuration.TimeZone)
+	if err != nil {
+		return time.Local
+	}
+	return location
+}
+
+// The front matter date of a metadata key, or of the fallback time when the document does not set it.
+// Both empty means there is no date to write.
+func frontMatterDate(metadata DocumentMetadata, key string, fallback time.Time, location *time.Location) (string, error) {
+	text := metadata.Values[key]
+	if text == "" {
+		if fallback.IsZero() {
+			return "", nil
+		}
+		return fallback.In(location).Format(time.RFC3339), nil
+	}
+	date, err := parseDocumentDate(text, location)
+	if err != nil {
+		return "", fmt.Errorf("DRVRKR_%s: %v", key, err)
+	}
+	return date.Format(time.RFC3339), nil
+}
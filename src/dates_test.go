@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDocumentDate(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, test := range []struct {
+		text string
+		want time.Time
+	}{
+		{"2017-05-04T09:30:15-07:00", time.Date(2017, 5, 4, 16, 30, 15, 0, time.UTC)},
+		{"2017-05-04T09:30Z", time.Date(2017, 5, 4, 9, 30, 0, 0, time.UTC)},
+		{"2017-05-04T09:30:15", time.Date(2017, 5, 4, 9, 30, 15, 0, berlin)},
+		{"2017-05-04T09:30", time.Date(2017, 5, 4, 9, 30, 0, 0, berlin)},
+		{"2017-05-04 09:30:15", time.Date(2017, 5, 4, 9, 30, 15, 0, berlin)},
+		{"2017-05-04 09:30", time.Date(2017, 5, 4, 9, 30, 0, 0, berlin)},
+		{"2017-05-04", time.Date(2017, 5, 4, 0, 0, 0, 0, berlin)},
+		{"2017 5 4 09:30", time.Date(2017, 5, 4, 9, 30, 0, 0, berlin)},
+		{"2017 5 4", time.Date(2017, 5, 4, 0, 0, 0, 0, berlin)},
+		{"2017/5/4", time.Date(2017, 5, 4, 0, 0, 0, 0, berlin)},
+		{"May 4, 2017 9:30 PM", time.Date(2017, 5, 4, 21, 30, 0, 0, berlin)},
+		{"May 4, 2017 21:30", time.Date(2017, 5, 4, 21, 30, 0, 0, berlin)},
+		{"May 4, 2017", time.Date(2017, 5, 4, 0, 0, 0, 0, berlin)},
+		{"May 4 2017", time.Date(2017, 5, 4, 0, 0, 0, 0, berlin)},
+		{"Sep 4, 2017", time.Date(2017, 9, 4, 0, 0, 0, 0, berlin)},
+		{"Sep 4 2017", time.Date(2017, 9, 4, 0, 0, 0, 0, berlin)},
+		{"4 September 2017", time.Date(2017, 9, 4, 0, 0, 0, 0, berlin)},
+		{"4 Sep 2017", time.Date(2017, 9, 4, 0, 0, 0, 0, berlin)},
+		// pandoc escapes and line wrapping
+		{"2017\\-05\\-04", time.Date(2017, 5, 4, 0, 0, 0, 0, berlin)},
+		{"  May  4,\n2017 ", time.Date(2017, 5, 4, 0, 0, 0, 0, berlin)},
+		// A leap day, and the time zone change of the last Sunday in March
+		{"2016-02-29", time.Date(2016, 2, 29, 0, 0, 0, 0, berlin)},
+		{"2017-03-26 12:00", time.Date(2017, 3, 26, 10, 0, 0, 0, time.UTC)},
+	} {
+		date, err := parseDocumentDate(test.text, berlin)
+		if err != nil {
+			t.Errorf("%q: %v", test.text, err)
+			continue
+		}
+		if !date.Equal(test.want) {
+			t.Errorf("%q is %v, want %v", test.text, date, test.want)
+		}
+	}
+}
+
+func TestParseDocumentDateRejects(t *testing.T) {
+	for _, text := range []string{
+		"2017-02-30",
+		"2017-02-29",
+		"2017-13-01",
+		"2017-05-04T25:00",
+		"April 31, 2017",
+		"05/04/2017",
+		"next Tuesday",
+		"",
+	} {
+		if date, err := parseDocumentDate(text, time.UTC); err == nil {
+			t.Errorf("%q was read as %v", text, date)
+		} else if !strings.Contains(err.Error(), "is not a date") {
+			t.Errorf("%q gave %v", text, err)
+		}
+	}
+}
+
+func TestFrontMatterDate(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	metadata := DocumentMetadata{Values: map[string]string{"PUB_DATE": "2017-05-04 09:30", "UPDATE_DATE": "2017-02-30"}}
+	fallback := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		key      string
+		fallback time.Time
+		want     string
+		err      string
+	}{
+		{"PUB_DATE", fallback, "2017-05-04T09:30:00+09:00", ""},
+		{"UPDATE_DATE", fallback, "", "DRVRKR_UPDATE_DATE: \"2017-02-30\" is not a date"},
+		{"OTHER_DATE", fallback, "2017-01-01T09:00:00+09:00", ""},
+		{"OTHER_DATE", time.Time{}, "", ""},
+	} {
+		date, err := frontMatterDate(metadata, test.key, test.fallback, tokyo)
+		if date != test.want || (err == nil) != (test.err == "") || err != nil && !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%s with fallback %v gave %q, %v, want %q, %s", test.key, test.fallback, date, err, test.want, test.err)
+		}
+	}
+}
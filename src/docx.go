@@ -0,0 +1,585 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Reads the docx file itself, writing markdown in the shape pandoc's markdown_strict does
+// so the rest of driveraker does not notice the difference
+type docxConverter struct{}
+
+func (docxConverter) Name() string {
+	return "the native converter"
+}
+
+func (docxConverter) Convert(docxFilePath string, markdownFilePath string) error {
+	document, err := readDocx(docxFilePath)
+	if err != nil {
+		return err
+	}
+	document.mediaDirectory = docxMediaDirectory(markdownFilePath)
+	err = extractDocxMedia(docxFilePath, document.mediaDirectory)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(markdownFilePath, []byte(document.markdown()), 0644)
+}
+
+// An element of the docx XML, by its local name without the namespace
+type xmlNode struct {
+	Name     string
+	Attrs    map[string]string
+	Children []*xmlNode
+	// Character data of elements like w:t
+	Text string
+}
+
+// The first child with the name
+func (node *xmlNode) child(name string) *xmlNode {
+	if node == nil {
+		return nil
+	}
+	for _, child := range node.Children {
+		if child.Name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+// The first descendant with the name
+func (node *xmlNode) find(name string) *xmlNode {
+	if node == nil {
+		return nil
+	}
+	for _, child := range node.Children {
+		if child.Name == name {
+			return child
+		}
+		if found := child.find(name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func (node *xmlNode) attr(name string) string {
+	if node == nil {
+		return ""
+	}
+	return node.Attrs[name]
+}
+
+// Whether an on/off property like w:b is on, <w:b/> and <w:b w:val="true"/> are but <w:b w:val="0"/> is not
+func (node *xmlNode) on() bool {
+	if node == nil {
+		return false
+	}
+	switch node.attr("val") {
+	case "0", "false", "off", "none":
+		return false
+	}
+	return true
+}
+
+// Parse an XML part of the docx into a tree
+func parseXMLNode(r io.Reader) (*xmlNode, error) {
+	decoder := xml.NewDecoder(r)
+	root := &xmlNode{}
+	stack := []*xmlNode{root}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		parent := stack[len(stack)-1]
+		switch token := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{Name: token.Name.Local, Attrs: make(map[string]string)}
+			for _, attr := range token.Attr {
+				node.Attrs[attr.Name.Local] = attr.Value
+			}
+			parent.Children = append(parent.Children, node)
+			stack = append(stack, node)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			parent.Text += string(token)
+		}
+	}
+	return root, nil
+}
+
+// What the converter needs from the parts of a docx file
+type docxDocument struct {
+	body *xmlNode
+	// Relationship targets by ID, for links and images
+	relationships map[string]string
+	// Where the embedded images are extracted to
+	mediaDirectory string
+	// Heading levels of paragraph styles by style ID
+	headingLevels map[string]int
+	// Whether each level of each numbering is ordered, by numbering ID then level
+	orderedLists map[string]map[string]bool
+	// Footnote contents by ID, and the IDs in the order the text refers to them
+	footnotes     map[string]*xmlNode
+	footnoteOrder []string
+	// Counters of ordered lists by numbering ID and level
+	listCounters map[string]map[int]int
+}
+
+func readDocx(docxFilePath string) (*docxDocument, error) {
+	archive, err := zip.OpenReader(docxFilePath)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	parts := make(map[string]*xmlNode)
+	for _, file := range archive.File {
+		switch file.Name {
+		case "word/document.xml", "word/_rels/document.xml.rels", "word/styles.xml", "word/numbering.xml", "word/footnotes.xml":
+			contents, err := file.Open()
+			if err != nil {
+				return nil, err
+			}
+			parts[file.Name], err = parseXMLNode(contents)
+			contents.Close()
+			if err != nil {
+				return nil, fmt.Errorf("reading %s: %v", file.Name, err)
+			}
+		}
+	}
+	if parts["word/document.xml"] == nil {
+		return nil, fmt.Errorf("%s has no word/document.xml, it is not a docx file", docxFilePath)
+	}
+	document := &docxDocument{
+		body:          parts["word/document.xml"].find("body"),
+		relationships: make(map[string]string),
+		headingLevels: make(map[string]int),
+		orderedLists:  make(map[string]map[string]bool),
+		footnotes:     make(map[string]*xmlNode),
+		listCounters:  make(map[string]map[int]int),
+	}
+	if relationships := parts["word/_rels/document.xml.rels"].child("Relationships"); relationships != nil {
+		for _, relationship := range relationships.Children {
+			document.relationships[relationship.attr("Id")] = relationship.attr("Target")
+		}
+	}
+	if styles := parts["word/styles.xml"].child("styles"); styles != nil {
+		for _, style := range styles.Children {
+			if level := headingLevel(style.child("name").attr("val")); level > 0 {
+				document.headingLevels[style.attr("styleId")] = level
+			}
+		}
+	}
+	if numbering := parts["word/numbering.xml"].child("numbering"); numbering != nil {
+		abstractLists := make(map[string]map[string]bool)
+		for _, abstract := range numbering.Children {
+			if abstract.Name != "abstractNum" {
+				continue
+			}
+			levels := make(map[string]bool)
+			for _, level := range abstract.Children {
+				if level.Name == "lvl" {
+					format := level.child("numFmt").attr("val")
+					levels[level.attr("ilvl")] = format != "" && format != "bullet" && format != "none"
+				}
+			}
+			abstractLists[abstract.attr("abstractNumId")] = levels
+		}
+		for _, num := range numbering.Children {
+			if num.Name == "num" {
+				document.orderedLists[num.attr("numId")] = abstractLists[num.child("abstractNumId").attr("val")]
+			}
+		}
+	}
+	if footnotes := parts["word/footnotes.xml"].child("footnotes"); footnotes != nil {
+		for _, footnote := range footnotes.Children {
+			// The separator lines above the footnotes are footnotes too
+			if footnote.Name == "footnote" && footnote.attr("type") == "" {
+				document.footnotes[footnote.attr("id")] = footnote
+			}
+		}
+	}
+	if document.body == nil {
+		document.body = &xmlNode{}
+	}
+	return document, nil
+}
+
+var headingStyleRegex = regexp.MustCompile(`^heading ([1-6])$`)
+
+// The heading level of a paragraph style by its name, 0 for other styles
+func headingLevel(styleName string) int {
+	styleName = strings.ToLower(styleName)
+	switch styleName {
+	case "title":
+		return 1
+	case "subtitle":
+		return 2
+	}
+	if match := headingStyleRegex.FindStringSubmatch(styleName); match != nil {
+		level, _ := strconv.Atoi(match[1])
+		return level
+	}
+	return 0
+}
+
+// A paragraph or table of the document as markdown
+type docxBlock struct {
+	Markdown string
+	// The numbering ID of a list item, items of a list follow each other without blank lines between them
+	List string
+}
+
+// The whole document as markdown, blocks separated by blank lines and list items by line breaks
+func (document *docxDocument) markdown() string {
+	var text bytes.Buffer
+	blocks := document.blocks(document.body)
+	for i, block := range blocks {
+		if i > 0 {
+			if block.List != "" && block.List == blocks[i-1].List {
+				text.WriteString("\n")
+			} else {
+				text.WriteString("\n\n")
+			}
+		}
+		text.WriteString(block.Markdown)
+	}
+	if notes := document.footnotesHTML(); notes != "" {
+		text.WriteString("\n\n" + notes)
+	}
+	text.WriteString("\n")
+	return text.String()
+}
+
+// The paragraphs and tables in a container
+func (document *docxDocument) blocks(container *xmlNode) (blocks []docxBlock) {
+	if container == nil {
+		return nil
+	}
+	for _, node := range container.Children {
+		switch node.Name {
+		case "p":
+			if block := document.paragraph(node); block.Markdown != "" {
+				blocks = append(blocks, block)
+			}
+		case "tbl":
+			blocks = append(blocks, docxBlock{Markdown: document.table(node)})
+		case "sdt":
+			// Content controls wrap ordinary blocks
+			blocks = append(blocks, document.blocks(node.child("sdtContent"))...)
+		}
+	}
+	return blocks
+}
+
+func (document *docxDocument) paragraph(p *xmlNode) docxBlock {
+	properties := p.child("pPr")
+	text := strings.TrimSpace(document.inline(p, false))
+	if text == "" {
+		return docxBlock{}
+	}
+	if level := document.headingLevels[properties.child("pStyle").attr("val")]; level > 0 {
+		return docxBlock{Markdown: strings.Repeat("#", level) + " " + text}
+	}
+	text = escapeBlockMarkers(text)
+	if numbering := properties.child("numPr"); numbering != nil {
+		numID := numbering.child("numId").attr("val")
+		// numId 0 turns numbering off
+		if numID != "" && numID != "0" {
+			return docxBlock{Markdown: document.listItem(numID, numbering.child("ilvl").attr("val"), text), List: numID}
+		}
+	}
+	return docxBlock{Markdown: text}
+}
+
+// A #, a - or + list marker or a line of - or = at the start of a line, and the number of an ordered list marker
+var (
+	blockMarkerRegex  = regexp.MustCompile(`(?m)^([ \t]*)(#|[-+](?:\s|$)|[-=]+[ \t]*$)`)
+	numberMarkerRegex = regexp.MustCompile(`(?m)^([ \t]*\d+)([.)](?:\s|$))`)
+)
+
+// Escape what would make a line of a paragraph a heading, a list item or a setext underline.
+// Quotes need nothing more, escapeMarkdown already escapes every >.
+func escapeBlockMarkers(text string) string {
+	text = blockMarkerRegex.ReplaceAllString(text, `$1\$2`)
+	return numberMarkerRegex.ReplaceAllString(text, `$1\$2`)
+}
+
+// A list item, indented four spaces a level like pandoc
+func (document *docxDocument) listItem(numID string, levelText string, text string) string {
+	level, _ := strconv.Atoi(levelText)
+	indent := strings.Repeat("    ", level)
+	if !document.orderedLists[numID][levelText] {
+		return indent + "-   " + text
+	}
+	counters := document.listCounters[numID]
+	if counters == nil {
+		counters = make(map[int]int)
+		document.listCounters[numID] = counters
+	}
+	counters[level]++
+	// A new item restarts the numbering of the levels under it
+	for deeper := range counters {
+		if deeper > level {
+			delete(counters, deeper)
+		}
+	}
+	marker := strconv.Itoa(counters[level]) + "."
+	return indent + marker + strings.Repeat(" ", 4-len(marker)%4) + text
+}
+
+// A run of text with its formatting, before adjacent runs with the same formatting are merged
+type docxSegment struct {
+	Text   string
+	Bold   bool
+	Italic bool
+	// Markup that is not escaped or formatted, like images and footnote references
+	Raw bool
+}
+
+// The text of the runs, links and images in a paragraph as markdown, or as HTML inside tables and footnotes
+func (document *docxDocument) inline(container *xmlNode, asHTML bool) string {
+	var segments []docxSegment
+	document.collectSegments(container, asHTML, &segments)
+	// Merge the runs word splits text into when the formatting does not change
+	var merged []docxSegment
+	for _, segment := range segments {
+		if last := len(merged) - 1; last >= 0 && !segment.Raw && !merged[last].Raw && merged[last].Bold == segment.Bold && merged[last].Italic == segment.Italic {
+			merged[last].Text += segment.Text
+			continue
+		}
+		merged = append(merged, segment)
+	}
+	var text bytes.Buffer
+	for _, segment := range merged {
+		if segment.Raw {
+			text.WriteString(segment.Text)
+			continue
+		}
+		text.WriteString(formatText(segment, asHTML))
+	}
+	return text.String()
+}
+
+func (document *docxDocument) collectSegments(container *xmlNode, asHTML bool, segments *[]docxSegment) {
+	if container == nil {
+		return
+	}
+	for _, node := range container.Children {
+		switch node.Name {
+		case "r":
+			document.runSegments(node, asHTML, segments)
+		case "hyperlink":
+			target := document.relationships[node.attr("id")]
+			if anchor := node.attr("anchor"); target == "" && anchor != "" {
+				target = "#" + anchor
+			}
+			text := document.inline(node, asHTML)
+			switch {
+			case target == "":
+				*segments = append(*segments, docxSegment{Text: text, Raw: true})
+			case asHTML:
+				*segments = append(*segments, docxSegment{Text: `<a href="` + html.EscapeString(target) + `">` + text + `</a>`, Raw: true})
+			default:
+				*segments = append(*segments, docxSegment{Text: "[" + text + "](" + target + ")", Raw: true})
+			}
+		case "ins", "smartTag", "fldSimple", "customXml":
+			// Accepted insertions and fields show their text, deletions in w:del do not
+			document.collectSegments(node, asHTML, segments)
+		case "sdt":
+			document.collectSegments(node.child("sdtContent"), asHTML, segments)
+		}
+	}
+}
+
+func (document *docxDocument) runSegments(run *xmlNode, asHTML bool, segments *[]docxSegment) {
+	properties := run.child("rPr")
+	bold := properties.child("b").on()
+	italic := properties.child("i").on()
+	for _, node := range run.Children {
+		switch node.Name {
+		case "t":
+			*segments = append(*segments, docxSegment{Text: node.Text, Bold: bold, Italic: italic})
+		case "tab":
+			*segments = append(*segments, docxSegment{Text: " ", Bold: bold, Italic: italic})
+		case "noBreakHyphen":
+			*segments = append(*segments, docxSegment{Text: "-", Bold: bold, Italic: italic})
+		case "br", "cr":
+			lineBreak := "  \n"
+			if asHTML {
+				lineBreak = "<br />"
+			}
+			*segments = append(*segments, docxSegment{Text: lineBreak, Raw: true})
+		case "drawing":
+			if image := document.image(node); image != "" {
+				*segments = append(*segments, docxSegment{Text: image, Raw: true})
+			}
+		case "footnoteReference":
+			*segments = append(*segments, docxSegment{Text: document.footnoteReference(node.attr("id")), Raw: true})
+		}
+	}
+}
+
+// Escape and format a segment, whitespace stays outside the emphasis markers
+func formatText(segment docxSegment, asHTML bool) string {
+	text := segment.Text
+	if asHTML {
+		text = html.EscapeString(text)
+	} else {
+		text = escapeMarkdown(text)
+	}
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" || !segment.Bold && !segment.Italic {
+		return text
+	}
+	open, close := "", ""
+	switch {
+	case asHTML && segment.Bold && segment.Italic:
+		open, close = "<strong><em>", "</em></strong>"
+	case asHTML && segment.Bold:
+		open, close = "<strong>", "</strong>"
+	case asHTML:
+		open, close = "<em>", "</em>"
+	case segment.Bold && segment.Italic:
+		open, close = "***", "***"
+	case segment.Bold:
+		open, close = "**", "**"
+	default:
+		open, close = "*", "*"
+	}
+	leading := text[:strings.Index(text, trimmed)]
+	trailing := text[len(leading)+len(trimmed):]
+	return leading + open + trimmed + close + trailing
+}
+
+var markdownSpecialCharacters = strings.NewReplacer(`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `[`, `\[`, `]`, `\]`, `<`, `\<`, `>`, `\>`)
+
+func escapeMarkdown(text string) string {
+	return markdownSpecialCharacters.Replace(text)
+}
+
+// An embedded image as the HTML img tag pandoc writes for images with a size
+func (document *docxDocument) image(drawing *xmlNode) string {
+	target := document.relationships[drawing.find("blip").attr("embed")]
+	if target == "" {
+		return ""
+	}
+	properties := drawing.find("docPr")
+	alt := properties.attr("descr")
+	if alt == "" {
+		alt = properties.attr("name")
+	}
+	// Linked images stay on the web, embedded ones are extracted
+	source := target
+	if !strings.Contains(target, "://") {
+		source = path.Clean(target)
+		if document.mediaDirectory != "" {
+			source = filepath.Join(document.mediaDirectory, filepath.FromSlash(source))
+		}
+	}
+	tag := `<img src="` + html.EscapeString(source) + `" alt="` + html.EscapeString(alt) + `"`
+	// Sizes are in EMU, 9525 to a pixel at 96 DPI
+	extent := drawing.find("extent")
+	width, widthErr := strconv.Atoi(extent.attr("cx"))
+	height, heightErr := strconv.Atoi(extent.attr("cy"))
+	if widthErr == nil && heightErr == nil {
+		tag += fmt.Sprintf(` width="%d" height="%d"`, width/9525, height/9525)
+	}
+	return tag + " />"
+}
+
+// A table as HTML, markdown_strict has no tables of its own
+func (document *docxDocument) table(tbl *xmlNode) string {
+	lines := []string{"<table>", "<tbody>"}
+	rowNumber := 0
+	for _, row := range tbl.Children {
+		if row.Name != "tr" {
+			continue
+		}
+		rowNumber++
+		class := "odd"
+		if rowNumber%2 == 0 {
+			class = "even"
+		}
+		lines = append(lines, `<tr class="`+class+`">`)
+		for _, cell := range row.Children {
+			if cell.Name != "tc" {
+				continue
+			}
+			var paragraphs []string
+			for _, p := range cell.Children {
+				if p.Name == "p" {
+					if text := strings.TrimSpace(document.inline(p, true)); text != "" {
+						paragraphs = append(paragraphs, text)
+					}
+				}
+			}
+			text := strings.Join(paragraphs, "")
+			if len(paragraphs) > 1 {
+				text = "<p>" + strings.Join(paragraphs, "</p>\n<p>") + "</p>"
+			}
+			lines = append(lines, "<td>"+text+"</td>")
+		}
+		lines = append(lines, "</tr>")
+	}
+	lines = append(lines, "</tbody>", "</table>")
+	return strings.Join(lines, "\n")
+}
+
+// A numbered link to a footnote, numbered in the order the text refers to them
+func (document *docxDocument) footnoteReference(id string) string {
+	number := 0
+	for i, referenced := range document.footnoteOrder {
+		if referenced == id {
+			number = i + 1
+		}
+	}
+	if number == 0 {
+		document.footnoteOrder = append(document.footnoteOrder, id)
+		number = len(document.footnoteOrder)
+	}
+	return fmt.Sprintf(`<sup><a href="#fn%d" class="footnote-ref" id="fnref%d">%d</a></sup>`, number, number, number)
+}
+
+// The footnotes the text refers to, as the HTML list pandoc puts at the end of a document
+func (document *docxDocument) footnotesHTML() string {
+	if len(document.footnoteOrder) == 0 {
+		return ""
+	}
+	lines := []string{`<div class="footnotes">`, "<hr />", "<ol>"}
+	// Footnotes can refer to other footnotes, which adds them to the end of the list
+	for i := 0; i < len(document.footnoteOrder); i++ {
+		var paragraphs []string
+		footnote := document.footnotes[document.footnoteOrder[i]]
+		if footnote == nil {
+			footnote = &xmlNode{}
+		}
+		for _, p := range footnote.Children {
+			if p.Name == "p" {
+				if text := strings.TrimSpace(document.inline(p, true)); text != "" {
+					paragraphs = append(paragraphs, text)
+				}
+			}
+		}
+		number := i + 1
+		lines = append(lines, fmt.Sprintf(`<li id="fn%d"><p>%s <a href="#fnref%d" class="footnote-back">↩</a></p></li>`, number, strings.Join(paragraphs, "</p><p>"), number))
+	}
+	lines = append(lines, "</ol>", "</div>")
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const wordNamespaces = `xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships" xmlns:wp="http://schemas.openxmlformats.org/drawingml/2006/wordprocessingDrawing" xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" xmlns:pic="http://schemas.openxmlformats.org/drawingml/2006/picture"`
+
+// The parts every test document shares: heading styles, a bulleted and an ordered list,
+// a link and an image relationship and a footnote
+var docxTestParts = map[string]string{
+	"word/styles.xml": `<w:styles ` + wordNamespaces + `>
+<w:style w:type="paragraph" w:styleId="Title"><w:name w:val="Title"/></w:style>
+<w:style w:type="paragraph" w:styleId="Subtitle"><w:name w:val="Subtitle"/></w:style>
+<w:style w:type="paragraph" w:styleId="Heading1"><w:name w:val="heading 1"/></w:style>
+<w:style w:type="paragraph" w:styleId="Heading3"><w:name w:val="heading 3"/></w:style>
+<w:style w:type="paragraph" w:styleId="Normal"><w:name w:val="Normal"/></w:style>
+</w:styles>`,
+	"word/numbering.xml": `<w:numbering ` + wordNamespaces + `>
+<w:abstractNum w:abstractNumId="0"><w:lvl w:ilvl="0"><w:numFmt w:val="bullet"/></w:lvl><w:lvl w:ilvl="1"><w:numFmt w:val="bullet"/></w:lvl></w:abstractNum>
+<w:abstractNum w:abstractNumId="1"><w:lvl w:ilvl="0"><w:numFmt w:val="decimal"/></w:lvl><w:lvl w:ilvl="1"><w:numFmt w:val="lowerLetter"/></w:lvl></w:abstractNum>
+<w:num w:numId="1"><w:abstractNumId w:val="0"/></w:num>
+<w:num w:numId="2"><w:abstractNumId w:val="1"/></w:num>
+</w:numbering>`,
+	"word/_rels/document.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/hyperlink" Target="https://example.org/?a=1&amp;b=2" TargetMode="External"/>
+<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/image" Target="media/image1.png"/>
+</Relationships>`,
+	"word/footnotes.xml": `<w:footnotes ` + wordNamespaces + `>
+<w:footnote w:type="separator" w:id="-1"><w:p><w:r><w:separator/></w:r></w:p></w:footnote>
+<w:footnote w:id="1"><w:p><w:r><w:t>The &lt;source&gt;.</w:t></w:r></w:p></w:footnote>
+</w:footnotes>`,
+	"word/media/image1.png": "not really a png",
+}
+
+// A paragraph of plain runs, with a style when one is given
+func docxParagraph(style string, runs ...string) string {
+	properties := ""
+	if style != "" {
+		properties = `<w:pPr><w:pStyle w:val="` + style + `"/></w:pPr>`
+	}
+	return `<w:p>` + properties + strings.Join(runs, "") + `</w:p>`
+}
+
+func docxRun(text string) string {
+	return `<w:r><w:t xml:space="preserve">` + text + `</w:t></w:r>`
+}
+
+// A list item of the numbering at the level
+func docxListItem(numID string, level string, text string) string {
+	return `<w:p><w:pPr><w:numPr><w:ilvl w:val="` + level + `"/><w:numId w:val="` + numID + `"/></w:numPr></w:pPr>` + docxRun(text) + `</w:p>`
+}
+
+// Write a docx file with the body and the shared parts
+func writeDocxParts(t *testing.T, docxFilePath string, body string) {
+	parts := map[string]string{"word/document.xml": `<w:document ` + wordNamespaces + `><w:body>` + body + `</w:body></w:document>`}
+	for name, contents := range docxTestParts {
+		parts[name] = contents
+	}
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	for name, contents := range parts {
+		part, err := writer.Create(name)
+		if err == nil {
+			_, err = part.Write([]byte(contents))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := writer.Close()
+	if err == nil {
+		err = ioutil.WriteFile(docxFilePath, archive.Bytes(), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDocxConverter(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		body string
+		// {media} stands for the directory the images are extracted to
+		want string
+	}{
+		{
+			"headings",
+			docxParagraph("Title", docxRun("The Title")) + docxParagraph("Subtitle", docxRun("The subtitle")) +
+				docxParagraph("Heading1", docxRun("Part one")) + docxParagraph("Heading3", docxRun("A detail")) +
+				docxParagraph("Normal", docxRun("Some text.")),
+			"# The Title\n\n## The subtitle\n\n# Part one\n\n### A detail\n\nSome text.\n",
+		},
+		{
+			"bold and italic",
+			docxParagraph("",
+				docxRun("Plain "),
+				`<w:r><w:rPr><w:b/></w:rPr><w:t xml:space="preserve">bold </w:t></w:r>`,
+				`<w:r><w:rPr><w:b/></w:rPr><w:t>split</w:t></w:r>`,
+				docxRun(", "),
+				`<w:r><w:rPr><w:i/></w:rPr><w:t>italic</w:t></w:r>`,
+				docxRun(", "),
+				`<w:r><w:rPr><w:b/><w:i/></w:rPr><w:t>both</w:t></w:r>`,
+				`<w:r><w:rPr><w:b w:val="0"/></w:rPr><w:t xml:space="preserve"> and *not* bold_</w:t></w:r>`),
+			"Plain **bold split**, *italic*, ***both*** and \\*not\\* bold\\_\n",
+		},
+		{
+			"hyperlinks",
+			docxParagraph("",
+				docxRun("See "),
+				`<w:hyperlink r:id="rId1">`+docxRun("the site")+`</w:hyperlink>`,
+				docxRun(" and "),
+				`<w:hyperlink w:anchor="part-one">`+docxRun("part one")+`</w:hyperlink>`,
+				docxRun(".")),
+			"See [the site](https://example.org/?a=1&b=2) and [part one](#part-one).\n",
+		},
+		{
+			"nested lists",
+			docxListItem("1", "0", "Apples") + docxListItem("1", "1", "Green") + docxListItem("1", "0", "Pears") +
+				docxParagraph("", docxRun("Steps:")) +
+				docxListItem("2", "0", "Mix") + docxListItem("2", "1", "Slowly") + docxListItem("2", "1", "Well") +
+				docxListItem("2", "0", "Bake") + docxListItem("2", "1", "Again"),
+			"-   Apples\n    -   Green\n-   Pears\n\nSteps:\n\n1.  Mix\n    1.  Slowly\n    2.  Well\n2.  Bake\n    1.  Again\n",
+		},
+		{
+			"tables",
+			`<w:tbl><w:tr><w:tc><w:p>` + docxRun("Name") + `</w:p></w:tc><w:tc><w:p>` + docxRun("A &amp; B") + `</w:p></w:tc></w:tr>` +
+				`<w:tr><w:tc><w:p><w:r><w:rPr><w:b/></w:rPr><w:t>Bold</w:t></w:r></w:p></w:tc><w:tc><w:p>` + docxRun("One") + `</w:p><w:p>` + docxRun("Two") + `</w:p></w:tc></w:tr></w:tbl>`,
+			"<table>\n<tbody>\n<tr class=\"odd\">\n<td>Name</td>\n<td>A &amp; B</td>\n</tr>\n<tr class=\"even\">\n<td><strong>Bold</strong></td>\n<td><p>One</p>\n<p>Two</p></td>\n</tr>\n</tbody>\n</table>\n",
+		},
+		{
+			"footnotes",
+			docxParagraph("", docxRun("A claim."), `<w:r><w:footnoteReference w:id="1"/></w:r>`, docxRun(" Again"), `<w:r><w:footnoteReference w:id="1"/></w:r>`),
+			"A claim.<sup><a href=\"#fn1\" class=\"footnote-ref\" id=\"fnref1\">1</a></sup> Again<sup><a href=\"#fn1\" class=\"footnote-ref\" id=\"fnref1\">1</a></sup>\n\n" +
+				"<div class=\"footnotes\">\n<hr />\n<ol>\n<li id=\"fn1\"><p>The &lt;source&gt;. <a href=\"#fnref1\" class=\"footnote-back\">↩</a></p></li>\n</ol>\n</div>\n",
+		},
+		{
+			"embedded images",
+			docxParagraph("", `<w:r><w:drawing><wp:inline><wp:extent cx="1905000" cy="952500"/><wp:docPr id="1" name="Picture 1" descr="A &quot;cat&quot;"/>`+
+				`<a:graphic><a:graphicData><pic:pic><pic:blipFill><a:blip r:embed="rId2"/></pic:blipFill></pic:pic></a:graphicData></a:graphic></wp:inline></w:drawing></w:r>`),
+			"<img src=\"{media}/media/image1.png\" alt=\"A &#34;cat&#34;\" width=\"200\" height=\"100\" />\n",
+		},
+		{
+			"leading markers",
+			docxParagraph("", docxRun("# not a heading")) + docxParagraph("", docxRun("1. not a list")) +
+				docxParagraph("", docxRun("2021) a year")) + docxParagraph("", docxRun("- not a bullet")) +
+				docxParagraph("", docxRun("+ nor this")) + docxParagraph("", docxRun("> not a quote")) +
+				docxParagraph("", docxRun("---")) + docxParagraph("", docxRun("A line"), `<w:r><w:br/></w:r>`, docxRun("=====")) +
+				docxListItem("1", "0", "- inside a list") +
+				docxParagraph("", docxRun("-1 degrees, 3.5 points, #hashtag")),
+			"\\# not a heading\n\n1\\. not a list\n\n2021\\) a year\n\n\\- not a bullet\n\n\\+ nor this\n\n\\> not a quote\n\n\\---\n\nA line  \n\\=====\n\n-   \\- inside a list\n\n-1 degrees, 3.5 points, #hashtag\n",
+		},
+	} {
+		directory := t.TempDir()
+		docxFilePath := filepath.Join(directory, "story.docx")
+		markdownFilePath := filepath.Join(directory, "story.md")
+		writeDocxParts(t, docxFilePath, test.body)
+		err := docxConverter{}.Convert(docxFilePath, markdownFilePath)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		contents, err := ioutil.ReadFile(markdownFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := strings.Replace(test.want, "{media}", docxMediaDirectory(markdownFilePath), -1)
+		if string(contents) != want {
+			t.Errorf("%s:\n%s\nwant\n%s", test.name, contents, want)
+		}
+		if strings.Contains(test.want, "{media}") {
+			if _, err := os.Stat(docxMediaDirectory(markdownFilePath) + "/media/image1.png"); err != nil {
+				t.Errorf("%s: the image was not extracted: %v", test.name, err)
+			}
+		}
+	}
+}
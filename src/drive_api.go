@@ -0,0 +1,567 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	googleDocumentMimeType = "application/vnd.google-apps.document"
+	googleFolderMimeType   = "application/vnd.google-apps.folder"
+	docxMimeType           = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	driveFileFields        = "id,name,mimeType,parents,trashed,modifiedTime,createdTime"
+)
+
+// A file as returned by the Drive v3 API
+type driveFile struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	MimeType     string   `json:"mimeType"`
+	Parents      []string `json:"parents"`
+	Trashed      bool     `json:"trashed"`
+	ModifiedTime string   `json:"modifiedTime"`
+	CreatedTime  string   `json:"createdTime"`
+}
+
+// What the Drive API source remembers about a document between runs,
+// so it can tell additions from modifications and spot moves
+type driveAPIFileState struct {
+	Path string
+}
+
+type driveAPIState struct {
+	Files map[string]driveAPIFileState
+	// Folders inside the synced folder, so renaming one moves the documents in it
+	Folders map[string]driveAPIFileState
+}
+
+// Talks to the Drive v3 API directly and uses changes.list page tokens as its cursor
+type driveAPISource struct {
+	Endpoint      string
+	TokenURL      string
+	ClientID      string
+	ClientSecret  string
+	RefreshToken  string
+	FolderID      string
+	SyncDirectory string
+	StatePath     string
+	Client        *http.Client
+	accessToken   string
+	tokenExpiry   time.Time
+	state         driveAPIState
+	// Folders looked up while resolving paths
+	folders map[string]driveFile
+}
+
+func newDriveAPISource(configuration Configuration) (*driveAPISource, error) {
+	if configuration.DriveAPIFolderID == "" {
+		return nil, fmt.Errorf("the api source needs DriveAPIFolderID")
+	}
+	source := &driveAPISource{
+		Endpoint:      configuration.DriveAPIEndpoint,
+		TokenURL:      configuration.DriveAPITokenURL,
+		ClientID:      configuration.DriveAPIClientID,
+		ClientSecret:  configuration.DriveAPIClientSecret,
+		RefreshToken:  configuration.DriveAPIRefreshToken,
+		FolderID:      configuration.DriveAPIFolderID,
+		SyncDirectory: configuration.DriveSyncDirectory,
+		StatePath:     configuration.HashtablePath + ".drive",
+		Client:        &http.Client{Timeout: 5 * time.Minute},
+		folders:       make(map[string]driveFile),
+	}
+	if source.Endpoint == "" {
+		source.Endpoint = "https://www.googleapis.com"
+	}
+	if source.TokenURL == "" {
+		source.TokenURL = "https://oauth2.googleapis.com/token"
+	}
+	err := source.readState()
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+func (source *driveAPISource) readState() error {
+	source.state = driveAPIState{Files: make(map[string]driveAPIFileState), Folders: make(map[string]driveAPIFileState)}
+	contents, err := ioutil.ReadFile(source.StatePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(contents, &source.state)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", source.StatePath, err)
+	}
+	if source.state.Files == nil {
+		source.state.Files = make(map[string]driveAPIFileState)
+	}
+	if source.state.Folders == nil {
+		source.state.Folders = make(map[string]driveAPIFileState)
+	}
+	return nil
+}
+
+func (source *driveAPISource) SaveState() error {
+	contents, err := json.Marshal(source.state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(source.StatePath, contents, 0644)
+}
+
+// Trade the refresh token for an access token when the current one is about to expire
+func (source *driveAPISource) authorize(request *http.Request) error {
+	if source.RefreshToken == "" {
+		return nil
+	}
+	if source.accessToken == "" || time.Now().After(source.tokenExpiry) {
+		response, err := source.Client.PostForm(source.TokenURL, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {source.ClientID},
+			"client_secret": {source.ClientSecret},
+			"refresh_token": {source.RefreshToken},
+		})
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return driveAPIError(response)
+		}
+		var token struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int    `json:"expires_in"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&token)
+		if err != nil {
+			return fmt.Errorf("decoding access token: %v", err)
+		}
+		source.accessToken = token.AccessToken
+		// Refresh a minute early so a token never expires mid-request
+		source.tokenExpiry = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	}
+	request.Header.Set("Authorization", "Bearer "+source.accessToken)
+	return nil
+}
+
+func driveAPIError(response *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	return fmt.Errorf("%s %s: %s: %s", response.Request.Method, response.Request.URL.Path, response.Status, strings.TrimSpace(string(body)))
+}
+
+// GET an API endpoint, the caller must close the body
+func (source *driveAPISource) get(endpoint string, query url.Values) (*http.Response, error) {
+	request, err := http.NewRequest("GET", source.Endpoint+endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	err = source.authorize(request)
+	if err != nil {
+		return nil, err
+	}
+	response, err := source.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		return nil, driveAPIError(response)
+	}
+	return response, nil
+}
+
+// GET an API endpoint and decode the JSON it returns
+func (source *driveAPISource) getJSON(endpoint string, query url.Values, value interface{}) error {
+	response, err := source.get(endpoint, query)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	return json.NewDecoder(response.Body).Decode(value)
+}
+
+func (source *driveAPISource) getFile(id string) (driveFile, error) {
+	if folder, ok := source.folders[id]; ok {
+		return folder, nil
+	}
+	var file driveFile
+	err := source.getJSON("/drive/v3/files/"+url.PathEscape(id), url.Values{"fields": {driveFileFields}}, &file)
+	if err == nil && file.MimeType == googleFolderMimeType {
+		source.folders[id] = file
+	}
+	return file, err
+}
+
+// A Drive name as one element of a local path. Drive allows slashes in names and names
+// like "..", which would otherwise write outside the sync directory.
+func driveName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, name)
+	switch name {
+	case "", ".":
+		return "_"
+	case "..":
+		return "__"
+	}
+	return name
+}
+
+// Work out the path of a file relative to the synced folder,
+// ok is false when the file lives outside of it
+func (source *driveAPISource) resolvePath(file driveFile) (string, bool, error) {
+	names := []string{driveName(file.Name)}
+	parents := file.Parents
+	// Guard against cycles, Drive folders are not nested this deep in practice
+	for depth := 0; depth < 64; depth++ {
+		if len(parents) == 0 {
+			return "", false, nil
+		}
+		if parents[0] == source.FolderID {
+			for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+				names[i], names[j] = names[j], names[i]
+			}
+			return path.Join(names...), true, nil
+		}
+		parent, err := source.getFile(parents[0])
+		if err != nil {
+			return "", false, err
+		}
+		names = append(names, driveName(parent.Name))
+		parents = parent.Parents
+	}
+	return "", false, nil
+}
+
+func (source *driveAPISource) document(file driveFile, filePath string) Document {
+	modified, _ := time.Parse(time.RFC3339, file.ModifiedTime)
+	created, _ := time.Parse(time.RFC3339, file.CreatedTime)
+	return Document{
+		ID:         file.ID,
+		Path:       filePath,
+		ExportPath: filepath.Join(source.SyncDirectory, filePath+".docx"),
+		Modified:   modified,
+		Created:    created,
+	}
+}
+
+// Describe a document from what was remembered about it
+func (source *driveAPISource) knownDocument(id string, known driveAPIFileState) Document {
+	return Document{
+		ID:         id,
+		Path:       known.Path,
+		ExportPath: filepath.Join(source.SyncDirectory, known.Path+".docx"),
+	}
+}
+
+// Walk the synced folder for Google Documents
+func (source *driveAPISource) ListDocuments() ([]Document, error) {
+	return source.listFolder(source.FolderID, "")
+}
+
+// Walk a folder at folderPath for Google Documents, remembering the folders inside it
+func (source *driveAPISource) listFolder(folderID string, folderPath string) ([]Document, error) {
+	var documents []Document
+	type folder struct {
+		ID   string
+		Path string
+	}
+	queue := []folder{{folderID, folderPath}}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		pageToken := ""
+		for {
+			query := url.Values{
+				"q":        {fmt.Sprintf("'%s' in parents and trashed = false", current.ID)},
+				"fields":   {"nextPageToken,files(" + driveFileFields + ")"},
+				"pageSize": {"1000"},
+			}
+			if pageToken != "" {
+				query.Set("pageToken", pageToken)
+			}
+			var list struct {
+				NextPageToken string      `json:"nextPageToken"`
+				Files         []driveFile `json:"files"`
+			}
+			err := source.getJSON("/drive/v3/files", query, &list)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range list.Files {
+				filePath := path.Join(current.Path, driveName(file.Name))
+				switch file.MimeType {
+				case googleFolderMimeType:
+					source.folders[file.ID] = file
+					source.state.Folders[file.ID] = driveAPIFileState{Path: filePath}
+					queue = append(queue, folder{file.ID, filePath})
+				case googleDocumentMimeType:
+					documents = append(documents, source.document(file, filePath))
+				}
+			}
+			if list.NextPageToken == "" {
+				break
+			}
+			pageToken = list.NextPageToken
+		}
+	}
+	return documents, nil
+}
+
+// Export the Google Document as docx into the sync directory, replacing the previous export
+// only once the new one is complete
+func (source *driveAPISource) FetchExport(document Document) (string, error) {
+	if !insideDirectory(source.SyncDirectory, document.ExportPath) {
+		return "", fmt.Errorf("%s is outside of the sync directory %s", document.ExportPath, source.SyncDirectory)
+	}
+	response, err := source.get("/drive/v3/files/"+url.PathEscape(document.ID)+"/export", url.Values{"mimeType": {docxMimeType}})
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	err = os.MkdirAll(filepath.Dir(document.ExportPath), 0755)
+	if err != nil {
+		return "", err
+	}
+	err = copyFileAtomic(document.ExportPath, response.Body, 0644)
+	if err != nil {
+		return "", err
+	}
+	return document.ExportPath, nil
+}
+
+// Whether filePath is inside directory once both are cleaned
+func insideDirectory(directory string, filePath string) bool {
+	relative, err := filepath.Rel(filepath.Clean(directory), filepath.Clean(filePath))
+	return err == nil && relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)) && !filepath.IsAbs(relative)
+}
+
+// With no cursor list everything and start following changes from now,
+// otherwise read changes.list until Drive hands back a new start page token
+func (source *driveAPISource) Changes(cursor string) ([]Change, string, error) {
+	var start struct {
+		StartPageToken string `json:"startPageToken"`
+	}
+	if cursor == "" {
+		// Take the token before listing so nothing changed during the listing is missed
+		err := source.getJSON("/drive/v3/changes/startPageToken", url.Values{}, &start)
+		if err != nil {
+			return nil, cursor, err
+		}
+		source.state.Folders = make(map[string]driveAPIFileState)
+		documents, err := source.ListDocuments()
+		if err != nil {
+			return nil, cursor, err
+		}
+		var changes []Change
+		source.state.Files = make(map[string]driveAPIFileState)
+		for _, document := range documents {
+			changes = append(changes, Change{ChangeAdded, document})
+			source.state.Files[document.ID] = driveAPIFileState{Path: document.Path}
+		}
+		return changes, start.StartPageToken, nil
+	}
+	// A file can change several times between runs, only its latest state matters
+	latest := make(map[string]driveChange)
+	var order []string
+	pageToken := cursor
+	newCursor := ""
+	for newCursor == "" {
+		var list struct {
+			NextPageToken     string        `json:"nextPageToken"`
+			NewStartPageToken string        `json:"newStartPageToken"`
+			Changes           []driveChange `json:"changes"`
+		}
+		err := source.getJSON("/drive/v3/changes", url.Values{
+			"pageToken":      {pageToken},
+			"includeRemoved": {"true"},
+			"spaces":         {"drive"},
+			"fields":         {"nextPageToken,newStartPageToken,changes(fileId,removed,file(" + driveFileFields + "))"},
+		}, &list)
+		if err != nil {
+			return nil, cursor, err
+		}
+		for _, change := range list.Changes {
+			if _, seen := latest[change.FileID]; !seen {
+				order = append(order, change.FileID)
+			}
+			latest[change.FileID] = change
+		}
+		newCursor = list.NewStartPageToken
+		pageToken = list.NextPageToken
+		if newCursor == "" && pageToken == "" {
+			return nil, cursor, fmt.Errorf("changes.list returned neither a next page nor a new start page token")
+		}
+	}
+	// Renaming a folder changes the documents in it as well, a document changes once however it was reached
+	changed := make(map[string]int)
+	var changes []Change
+	for _, id := range order {
+		interpreted, err := source.interpretChange(latest[id])
+		if err != nil {
+			return nil, cursor, err
+		}
+		for _, change := range interpreted {
+			i, seen := changed[change.Document.ID]
+			if !seen {
+				changed[change.Document.ID] = len(changes)
+				changes = append(changes, change)
+				continue
+			}
+			changes[i] = mergeChanges(changes[i], change)
+		}
+	}
+	return changes, newCursor, nil
+}
+
+// The change a document went through when two changes reached it, e.g. its folder was renamed and it was edited
+func mergeChanges(first Change, second Change) Change {
+	if second.Kind == ChangeDeleted || first.Kind == ChangeDeleted {
+		return second
+	}
+	if first.Kind == ChangeAdded || first.Kind == ChangeMoved {
+		second.Kind = first.Kind
+	}
+	return second
+}
+
+type driveChange struct {
+	FileID  string     `json:"fileId"`
+	Removed bool       `json:"removed"`
+	File    *driveFile `json:"file"`
+}
+
+// Compare a change against what we knew about the file, no changes means it does not concern us
+func (source *driveAPISource) interpretChange(change driveChange) ([]Change, error) {
+	if _, isFolder := source.state.Folders[change.FileID]; isFolder || change.File != nil && change.File.MimeType == googleFolderMimeType {
+		return source.interpretFolderChange(change)
+	}
+	known, wasKnown := source.state.Files[change.FileID]
+	if change.Removed || change.File == nil || change.File.Trashed {
+		if !wasKnown {
+			return nil, nil
+		}
+		delete(source.state.Files, change.FileID)
+		return []Change{{ChangeDeleted, source.knownDocument(change.FileID, known)}}, nil
+	}
+	file := *change.File
+	if file.MimeType != googleDocumentMimeType {
+		return nil, nil
+	}
+	filePath, inside, err := source.resolvePath(file)
+	if err != nil {
+		return nil, err
+	}
+	if !inside {
+		// Moving a document out of the synced folder is the same as deleting it
+		if !wasKnown {
+			return nil, nil
+		}
+		delete(source.state.Files, file.ID)
+		return []Change{{ChangeDeleted, source.knownDocument(file.ID, known)}}, nil
+	}
+	source.state.Files[file.ID] = driveAPIFileState{Path: filePath}
+	document := source.document(file, filePath)
+	switch {
+	case !wasKnown:
+		return []Change{{ChangeAdded, document}}, nil
+	case known.Path != filePath:
+		return []Change{{ChangeMoved, document}}, nil
+	}
+	return []Change{{ChangeModified, document}}, nil
+}
+
+// A folder that was renamed, moved or removed takes the documents in it along.
+// Drive only reports the folder itself, so the documents are found by their remembered paths.
+func (source *driveAPISource) interpretFolderChange(change driveChange) ([]Change, error) {
+	// Forget the cached folder, it may have been renamed or moved
+	delete(source.folders, change.FileID)
+	known, wasKnown := source.state.Folders[change.FileID]
+	folderPath, inside := "", false
+	if !change.Removed && change.File != nil && !change.File.Trashed {
+		var err error
+		folderPath, inside, err = source.resolvePath(*change.File)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if inside {
+		source.state.Folders[change.FileID] = driveAPIFileState{Path: folderPath}
+	} else {
+		delete(source.state.Folders, change.FileID)
+	}
+	if !wasKnown && inside {
+		return source.interpretNewFolder(change.FileID, folderPath)
+	}
+	if !wasKnown || known.Path == folderPath {
+		return nil, nil
+	}
+	prefix := known.Path + "/"
+	for id, folder := range source.state.Folders {
+		if strings.HasPrefix(folder.Path, prefix) {
+			if inside {
+				source.state.Folders[id] = driveAPIFileState{Path: folderPath + "/" + strings.TrimPrefix(folder.Path, prefix)}
+			} else {
+				delete(source.state.Folders, id)
+			}
+		}
+	}
+	var ids []string
+	for id, file := range source.state.Files {
+		if strings.HasPrefix(file.Path, prefix) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	var changes []Change
+	for _, id := range ids {
+		document := source.knownDocument(id, source.state.Files[id])
+		if !inside {
+			delete(source.state.Files, id)
+			changes = append(changes, Change{ChangeDeleted, document})
+			continue
+		}
+		filePath := folderPath + "/" + strings.TrimPrefix(document.Path, prefix)
+		source.state.Files[id] = driveAPIFileState{Path: filePath}
+		document.Path = filePath
+		document.ExportPath = filepath.Join(source.SyncDirectory, filePath+".docx")
+		changes = append(changes, Change{ChangeMoved, document})
+	}
+	return changes, nil
+}
+
+// A folder moved into the synced folder brings its documents along, Drive reports none of them
+func (source *driveAPISource) interpretNewFolder(folderID string, folderPath string) ([]Change, error) {
+	documents, err := source.listFolder(folderID, folderPath)
+	if err != nil {
+		return nil, err
+	}
+	var changes []Change
+	for _, document := range documents {
+		known, wasKnown := source.state.Files[document.ID]
+		source.state.Files[document.ID] = driveAPIFileState{Path: document.Path}
+		switch {
+		case !wasKnown:
+			changes = append(changes, Change{ChangeAdded, document})
+		case known.Path != document.Path:
+			changes = append(changes, Change{ChangeMoved, document})
+		}
+	}
+	return changes, nil
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A stand-in for the Drive v3 API and Google's token endpoint
+type fakeDrive struct {
+	t *testing.T
+	// Files by ID, for files.get and for listing folders
+	files map[string]driveFile
+	// Pages of changes.list by page token
+	changes map[string]map[string]interface{}
+	// Exported docx contents by document ID
+	exports map[string]string
+	// How many more exports of a document fail with 503
+	failExports map[string]int
+	// Seconds the access tokens it hands out last
+	expiresIn     int
+	tokenRequests int
+	lastToken     string
+	// Page size of files.list, to exercise paging
+	pageSize int
+}
+
+func newFakeDrive(t *testing.T) (*fakeDrive, *httptest.Server) {
+	drive := &fakeDrive{
+		t:           t,
+		files:       make(map[string]driveFile),
+		changes:     make(map[string]map[string]interface{}),
+		exports:     make(map[string]string),
+		failExports: make(map[string]int),
+		expiresIn:   3600,
+		pageSize:    1,
+	}
+	server := httptest.NewServer(drive)
+	t.Cleanup(server.Close)
+	return drive, server
+}
+
+func (drive *fakeDrive) add(file driveFile) {
+	drive.files[file.ID] = file
+}
+
+func (drive *fakeDrive) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.URL.Path == "/token" {
+		drive.tokenRequests++
+		if request.FormValue("refresh_token") != "refresh" || request.FormValue("grant_type") != "refresh_token" {
+			http.Error(writer, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		drive.lastToken = "token-" + strings.Repeat("x", drive.tokenRequests)
+		json.NewEncoder(writer).Encode(map[string]interface{}{"access_token": drive.lastToken, "expires_in": drive.expiresIn})
+		return
+	}
+	if request.Header.Get("Authorization") != "Bearer "+drive.lastToken || drive.lastToken == "" {
+		http.Error(writer, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	query := request.URL.Query()
+	switch {
+	case request.URL.Path == "/drive/v3/changes/startPageToken":
+		json.NewEncoder(writer).Encode(map[string]string{"startPageToken": "100"})
+	case request.URL.Path == "/drive/v3/changes":
+		page, ok := drive.changes[query.Get("pageToken")]
+		if !ok {
+			http.Error(writer, "unknown page token", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(writer).Encode(page)
+	case request.URL.Path == "/drive/v3/files":
+		drive.list(writer, query.Get("q"), query.Get("pageToken"))
+	case strings.HasSuffix(request.URL.Path, "/export"):
+		id := strings.TrimSuffix(strings.TrimPrefix(request.URL.Path, "/drive/v3/files/"), "/export")
+		if query.Get("mimeType") != docxMimeType {
+			http.Error(writer, "bad export type", http.StatusBadRequest)
+			return
+		}
+		if drive.failExports[id] > 0 {
+			drive.failExports[id]--
+			http.Error(writer, "backend error", http.StatusServiceUnavailable)
+			return
+		}
+		contents, ok := drive.exports[id]
+		if !ok {
+			http.NotFound(writer, request)
+			return
+		}
+		writer.Write([]byte(contents))
+	case strings.HasPrefix(request.URL.Path, "/drive/v3/files/"):
+		file, ok := drive.files[strings.TrimPrefix(request.URL.Path, "/drive/v3/files/")]
+		if !ok {
+			http.NotFound(writer, request)
+			return
+		}
+		json.NewEncoder(writer).Encode(file)
+	default:
+		http.NotFound(writer, request)
+	}
+}
+
+// files.list for a "'<id>' in parents" query, pageSize files at a time with the page token as an offset
+func (drive *fakeDrive) list(writer http.ResponseWriter, q string, pageToken string) {
+	parent := strings.SplitN(strings.TrimPrefix(q, "'"), "'", 2)[0]
+	var children []driveFile
+	for _, id := range sortedFileIDs(drive.files) {
+		file := drive.files[id]
+		if len(file.Parents) > 0 && file.Parents[0] == parent && !file.Trashed {
+			children = append(children, file)
+		}
+	}
+	offset := len(pageToken)
+	end := offset + drive.pageSize
+	response := map[string]interface{}{}
+	if end < len(children) {
+		response["nextPageToken"] = strings.Repeat("p", end)
+	} else {
+		end = len(children)
+	}
+	response["files"] = children[offset:end]
+	json.NewEncoder(writer).Encode(response)
+}
+
+func sortedFileIDs(files map[string]driveFile) (ids []string) {
+	for id := range files {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func newTestDriveAPISource(t *testing.T, server *httptest.Server) *driveAPISource {
+	directory := t.TempDir()
+	source, err := newDriveAPISource(Configuration{
+		DriveAPIEndpoint:     server.URL,
+		DriveAPITokenURL:     server.URL + "/token",
+		DriveAPIClientID:     "client",
+		DriveAPIClientSecret: "secret",
+		DriveAPIRefreshToken: "refresh",
+		DriveAPIFolderID:     "root",
+		DriveSyncDirectory:   filepath.Join(directory, "sync") + "/",
+		HashtablePath:        filepath.Join(directory, "state.json"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source
+}
+
+func document(id string, name string, parent string) driveFile {
+	return driveFile{ID: id, Name: name, MimeType: googleDocumentMimeType, Parents: []string{parent}, ModifiedTime: "2017-05-04T09:30:00Z"}
+}
+
+func folder(id string, name string, parent string) driveFile {
+	return driveFile{ID: id, Name: name, MimeType: googleFolderMimeType, Parents: []string{parent}}
+}
+
+// The kind and path of each change, for comparing
+func changeSummary(changes []Change) (summary []string) {
+	for _, change := range changes {
+		summary = append(summary, change.Kind.String()+" "+change.Document.ID+" "+change.Document.Path)
+	}
+	return summary
+}
+
+func TestDriveAPIChangesWithoutCursorListsEverything(t *testing.T) {
+	drive, server := newFakeDrive(t)
+	drive.add(document("d1", "Hello World", "root"))
+	drive.add(document("d2", "Second", "root"))
+	drive.add(folder("f1", "Sports", "root"))
+	drive.add(document("d3", "Game", "f1"))
+	drive.add(driveFile{ID: "s1", Name: "Budget", MimeType: "application/vnd.google-apps.spreadsheet", Parents: []string{"root"}})
+	source := newTestDriveAPISource(t, server)
+	changes, cursor, err := source.Changes("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != "100" {
+		t.Errorf("cursor is %q, want the start page token 100", cursor)
+	}
+	want := []string{"added d1 Hello World", "added d2 Second", "added d3 Sports/Game"}
+	if got := changeSummary(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("changes are %q, want %q", got, want)
+	}
+	if changes[2].Document.ExportPath != filepath.Join(source.SyncDirectory, "Sports/Game.docx") {
+		t.Errorf("export path is %s", changes[2].Document.ExportPath)
+	}
+	if changes[0].Document.Modified.IsZero() {
+		t.Errorf("the modified time was not read")
+	}
+}
+
+func TestDriveAPIChangesFollowsPages(t *testing.T) {
+	drive, server := newFakeDrive(t)
+	drive.add(folder("f1", "Sports", "root"))
+	source := newTestDriveAPISource(t, server)
+	source.state.Files["known"] = driveAPIFileState{Path: "Known"}
+	source.state.Files["moved"] = driveAPIFileState{Path: "Old name"}
+	source.state.Files["gone"] = driveAPIFileState{Path: "Gone"}
+	newDocument := document("new", "New", "root")
+	drive.changes["100"] = map[string]interface{}{
+		"nextPageToken": "101",
+		"changes": []interface{}{
+			map[string]interface{}{"fileId": "new", "file": newDocument},
+			map[string]interface{}{"fileId": "known", "file": document("known", "Known draft", "root")},
+		},
+	}
+	drive.changes["101"] = map[string]interface{}{
+		"newStartPageToken": "102",
+		"changes": []interface{}{
+			// The latest state of a file that changed twice wins
+			map[string]interface{}{"fileId": "known", "file": document("known", "Known", "root")},
+			map[string]interface{}{"fileId": "moved", "file": document("moved", "New name", "f1")},
+			map[string]interface{}{"fileId": "gone", "removed": true},
+			map[string]interface{}{"fileId": "stranger", "removed": true},
+		},
+	}
+	changes, cursor, err := source.Changes("100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != "102" {
+		t.Errorf("cursor is %q, want the new start page token 102", cursor)
+	}
+	want := []string{"added new New", "modified known Known", "moved moved Sports/New name", "deleted gone Gone"}
+	if got := changeSummary(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("changes are %q, want %q", got, want)
+	}
+	if _, remembered := source.state.Files["gone"]; remembered {
+		t.Errorf("the deleted document is still remembered")
+	}
+}
+
+func TestDriveAPIChangesSavesStateOnlyWhenAsked(t *testing.T) {
+	drive, server := newFakeDrive(t)
+	drive.add(document("d1", "Hello World", "root"))
+	source := newTestDriveAPISource(t, server)
+	_, _, err := source.Changes("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved, _ := exists(source.StatePath); saved {
+		t.Fatalf("Changes saved the state before the manifest")
+	}
+	err = source.SaveState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reread := newTestDriveAPISource(t, server)
+	reread.StatePath = source.StatePath
+	err = reread.readState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reread.state.Files["d1"].Path != "Hello World" {
+		t.Errorf("the saved state is %+v", reread.state)
+	}
+}
+
+// Sync the way runSync does, saving the source state once the manifest has the changes
+func syncOnce(t *testing.T, source Source, manifest *Manifest, configuration Configuration) {
+	syncMessage := make(chan error, 1)
+	var driveSync sync.WaitGroup
+	driveSync.Add(1)
+	go syncGoogleDrive(source, manifest, configuration, &driveSync, syncMessage)
+	driveSync.Wait()
+	err := <-syncMessage
+	if err == nil {
+		err = source.SaveState()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncRetriesFailedExports(t *testing.T) {
+	drive, server := newFakeDrive(t)
+	drive.add(document("d1", "Hello World", "root"))
+	drive.add(document("d2", "Second", "root"))
+	drive.exports["d1"] = "hello"
+	drive.exports["d2"] = "second"
+	drive.failExports["d1"] = 1
+	drive.changes["100"] = map[string]interface{}{"newStartPageToken": "100", "changes": []interface{}{}}
+	source := newTestDriveAPISource(t, server)
+	manifest := NewManifest()
+	configuration := Configuration{HugoPostDirectory: t.TempDir() + "/"}
+	configuration.applyDefaults()
+	syncOnce(t, source, manifest, configuration)
+	if manifest.Cursor != "100" {
+		t.Errorf("the cursor is %q, a failed export must not hold up the others", manifest.Cursor)
+	}
+	if entry := manifest.Documents["d1"]; entry == nil || entry.Unfetched == nil || entry.ExportSHA256 != "" || !strings.Contains(entry.FetchError, "503") {
+		t.Fatalf("the failed export left %+v", entry)
+	}
+	if entry := manifest.Documents["d2"]; entry == nil || entry.ExportSHA256 == "" {
+		t.Fatalf("the second document is %+v", entry)
+	}
+	// Drive reports no changes past the cursor, the failed export is fetched from the manifest
+	syncOnce(t, source, manifest, configuration)
+	entry := manifest.Documents["d1"]
+	if entry.Unfetched != nil || entry.FetchError != "" || !entry.Pending() || entry.SourcePath != "Hello World" {
+		t.Errorf("the retried export left %+v", entry)
+	}
+	if contents, _ := ioutil.ReadFile(entry.ExportPath); string(contents) != "hello" {
+		t.Errorf("the export holds %q", contents)
+	}
+}
+
+func TestDriveAPIFolderRenameMovesItsDocuments(t *testing.T) {
+	drive, server := newFakeDrive(t)
+	drive.add(folder("f1", "Sports", "root"))
+	drive.add(folder("f2", "Local", "f1"))
+	drive.add(document("d1", "Game", "f1"))
+	drive.add(document("d2", "Match", "f2"))
+	drive.add(document("d3", "Elsewhere", "root"))
+	// The folder is renamed, and one of its documents is edited as well
+	renamed := folder("f1", "Athletics", "root")
+	drive.add(renamed)
+	drive.changes["100"] = map[string]interface{}{
+		"newStartPageToken": "101",
+		"changes": []interface{}{
+			map[string]interface{}{"fileId": "d1", "file": document("d1", "Game", "f1")},
+			map[string]interface{}{"fileId": "f1", "file": renamed},
+		},
+	}
+	source := newTestDriveAPISource(t, server)
+	source.state.Files = map[string]driveAPIFileState{"d1": {Path: "Sports/Game"}, "d2": {Path: "Sports/Local/Match"}, "d3": {Path: "Elsewhere"}}
+	source.state.Folders = map[string]driveAPIFileState{"f1": {Path: "Sports"}, "f2": {Path: "Sports/Local"}}
+	changes, _, err := source.Changes("100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"moved d1 Athletics/Game", "moved d2 Athletics/Local/Match"}
+	if got := changeSummary(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("changes are %q, want %q", got, want)
+	}
+	if source.state.Folders["f2"].Path != "Athletics/Local" {
+		t.Errorf("the nested folder is remembered at %q", source.state.Folders["f2"].Path)
+	}
+	// Trashing the folder deletes what is in it
+	drive.changes["101"] = map[string]interface{}{
+		"newStartPageToken": "102",
+		"changes":           []interface{}{map[string]interface{}{"fileId": "f1", "removed": true}},
+	}
+	changes, _, err = source.Changes("101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"deleted d1 Athletics/Game", "deleted d2 Athletics/Local/Match"}
+	if got := changeSummary(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("changes are %q, want %q", got, want)
+	}
+}
+
+func TestDriveAPIFolderMovedInBringsItsDocuments(t *testing.T) {
+	drive, server := newFakeDrive(t)
+	drive.add(folder("f1", "Reporting", "root"))
+	drive.add(folder("f2", "Drafts", "f1"))
+	drive.add(document("d1", "Scoop", "f1"))
+	drive.add(document("d2", "Rumour", "f2"))
+	drive.add(document("d3", "Known", "f1"))
+	drive.changes["100"] = map[string]interface{}{
+		"newStartPageToken": "101",
+		"changes":           []interface{}{map[string]interface{}{"fileId": "f1", "file": folder("f1", "Reporting", "root")}},
+	}
+	source := newTestDriveAPISource(t, server)
+	source.state.Files = map[string]driveAPIFileState{"d3": {Path: "Known"}}
+	changes, _, err := source.Changes("100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"added d1 Reporting/Scoop", "moved d3 Reporting/Known", "added d2 Reporting/Drafts/Rumour"}
+	if got := changeSummary(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("changes are %q, want %q", got, want)
+	}
+	if source.state.Folders["f2"].Path != "Reporting/Drafts" || source.state.Files["d2"].Path != "Reporting/Drafts/Rumour" {
+		t.Errorf("the state is %+v", source.state)
+	}
+}
+
+func TestMovedDocumentKeepsItsModificationTime(t *testing.T) {
+	manifest := NewManifest()
+	configuration := Configuration{HugoPostDirectory: t.TempDir() + "/"}
+	configuration.applyDefaults()
+	modified := time.Date(2017, 5, 4, 9, 30, 0, 0, time.UTC)
+	trackArticle(manifest, Document{ID: "d1", Path: "Sports/Game", Modified: modified}, configuration)
+	// Documents moved along with their folder are described from the state, without times
+	entry := trackArticle(manifest, Document{ID: "d1", Path: "Athletics/Game"}, configuration)
+	if !entry.SourceModified.Equal(modified) || !entry.SourceCreated.Equal(modified) {
+		t.Errorf("modified %v and created %v, want %v", entry.SourceModified, entry.SourceCreated, modified)
+	}
+}
+
+func TestDriveAPINamesStayInsideTheSyncDirectory(t *testing.T) {
+	drive, server := newFakeDrive(t)
+	drive.add(folder("f1", "..", "root"))
+	drive.add(document("d1", "../../etc/passwd", "f1"))
+	drive.add(document("d2", "/absolute", "root"))
+	source := newTestDriveAPISource(t, server)
+	changes, _, err := source.Changes("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range changes {
+		if !insideDirectory(source.SyncDirectory, change.Document.ExportPath) {
+			t.Errorf("%s is outside of the sync directory", change.Document.ExportPath)
+		}
+	}
+	want := []string{"added d2 _absolute", "added d1 __/.._.._etc_passwd"}
+	if got := changeSummary(changes); !reflect.DeepEqual(got, want) {
+		t.Errorf("changes are %q, want %q", got, want)
+	}
+	_, err = source.FetchExport(Document{ID: "d1", ExportPath: filepath.Join(source.SyncDirectory, "../outside.docx")})
+	if err == nil {
+		t.Errorf("exported outside of the sync directory")
+	}
+}
+
+func TestDriveName(t *testing.T) {
+	for name, want := range map[string]string{
+		"Hello World": "Hello World",
+		"Q1/Q2":       "Q1_Q2",
+		"..":          "__",
+		".":           "_",
+		"":            "_",
+		"a\\b":        "a_b",
+		"Café ..":     "Café ..",
+	} {
+		if got := driveName(name); got != want {
+			t.Errorf("driveName(%q) is %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestDriveAPIFetchExport(t *testing.T) {
+	drive, server := newFakeDrive(t)
+	drive.exports["d1"] = "new export"
+	source := newTestDriveAPISource(t, server)
+	exportPath := filepath.Join(source.SyncDirectory, "Sports", "Game.docx")
+	err := os.MkdirAll(filepath.Dir(exportPath), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(exportPath, []byte("old export"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetched, err := source.FetchExport(Document{ID: "d1", Path: "Sports/Game", ExportPath: exportPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents, _ := ioutil.ReadFile(fetched)
+	if string(contents) != "new export" {
+		t.Errorf("the export holds %q", contents)
+	}
+	// A failed export keeps the previous one
+	_, err = source.FetchExport(Document{ID: "missing", Path: "Sports/Game", ExportPath: exportPath})
+	if err == nil {
+		t.Errorf("exporting a missing document did not fail")
+	}
+	contents, _ = ioutil.ReadFile(exportPath)
+	if string(contents) != "new export" {
+		t.Errorf("a failed export left %q", contents)
+	}
+	if leftovers := leftoverTempFiles(filepath.Dir(exportPath)); len(leftovers) > 0 {
+		t.Errorf("temporary files were left behind: %v", leftovers)
+	}
+}
+
+func TestDriveAPITokenRefresh(t *testing.T) {
+	drive, server := newFakeDrive(t)
+	drive.add(document("d1", "Hello World", "root"))
+	source := newTestDriveAPISource(t, server)
+	for i := 0; i < 3; i++ {
+		_, err := source.getFile("d1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if drive.tokenRequests != 1 {
+		t.Errorf("asked for %d access tokens, want the first one to be reused", drive.tokenRequests)
+	}
+	// Tokens are refreshed a minute before they expire
+	drive.expiresIn = 30
+	source.accessToken = ""
+	for i := 0; i < 2; i++ {
+		_, err := source.getFile("d1")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if drive.tokenRequests != 3 {
+		t.Errorf("asked for %d access tokens, want a new one for each request once they are about to expire", drive.tokenRequests)
+	}
+	source.RefreshToken = "revoked"
+	_, err := source.getFile("d1")
+	if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("a revoked refresh token gave %v", err)
+	}
+}
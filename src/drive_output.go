@@ -0,0 +1,141 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type driveEventKind int
+
+const (
+	driveEventAdded driveEventKind = iota
+	driveEventModified
+	driveEventDeleted
+	driveEventExported
+	driveEventError
+)
+
+func (kind driveEventKind) String() string {
+	switch kind {
+	case driveEventAdded:
+		return "Added"
+	case driveEventModified:
+		return "Modified"
+	case driveEventDeleted:
+		return "Deleted"
+	case driveEventExported:
+		return "Exported"
+	case driveEventError:
+		return "Error"
+	}
+	return "Unknown"
+}
+
+// One thing the drive CLI reported doing during a pull
+type driveEvent struct {
+	Kind driveEventKind
+	// The remote path for Added, Modified and Deleted, the local source for Exported,
+	// and the path the error concerns for Error
+	Path string
+	// The local docx for Exported
+	Destination string
+	// What went wrong for Error
+	Message string
+}
+
+// The progress bars drive draws with carriage returns, e.g. " 0 / 568792 [-----]   0.00% 1s". The time
+// always has a unit, so the count of a bar drawn straight after one is not taken for it.
+var driveProgressBar = regexp.MustCompile(`^\s*\d+ / \d+ \[[=>\-]*\]\s+[\d.]+%( ([\d.]+[a-zµ]+)+)?`)
+
+// Turn the transcript of a drive pull into events. Paths are taken verbatim,
+// so spaces, quotes and non-ASCII names survive.
+func parseDriveOutput(transcript string) (events []driveEvent) {
+	transcript = strings.Replace(transcript, "\r\n", "\n", -1)
+	for _, line := range strings.FieldsFunc(transcript, func(r rune) bool { return r == '\n' || r == '\r' }) {
+		// Output often continues on the same line as a progress bar
+		for {
+			bar := driveProgressBar.FindString(line)
+			if bar == "" {
+				break
+			}
+			line = line[len(bar):]
+		}
+		if event, ok := parseDriveLine(line); ok {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func parseDriveLine(line string) (driveEvent, bool) {
+	switch {
+	case strings.HasPrefix(line, "+ /"):
+		return driveEvent{Kind: driveEventAdded, Path: line[2:]}, true
+	case strings.HasPrefix(line, "M /"):
+		return driveEvent{Kind: driveEventModified, Path: line[2:]}, true
+	case strings.HasPrefix(line, "- /"):
+		return driveEvent{Kind: driveEventDeleted, Path: line[2:]}, true
+	case strings.HasPrefix(line, "Exported '"):
+		return parseDriveExport(strings.TrimSpace(line[len("Exported '"):]))
+	case strings.HasPrefix(line, "localDelete: "):
+		// localDelete: "<quoted path>" <error>
+		rest := line[len("localDelete: "):]
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return driveEvent{Kind: driveEventError, Message: strings.TrimSpace(line)}, true
+		}
+		unquoted, _ := strconv.Unquote(quoted)
+		return driveEvent{Kind: driveEventError, Path: unquoted, Message: strings.TrimSpace(rest[len(quoted):])}, true
+	case strings.HasPrefix(line, "/") && strings.Contains(line, " err: "):
+		// <remote path> err: <error>
+		i := strings.Index(line, " err: ")
+		return driveEvent{Kind: driveEventError, Path: line[:i], Message: strings.TrimSpace(line[i+len(" err: "):])}, true
+	}
+	return driveEvent{}, false
+}
+
+// What follows "Exported '" is "<source>' to '<destination>'". Both may contain
+// "' to '" themselves, so prefer the split where the destination sits in the
+// source's _exports directory, which is where drive always puts it.
+func parseDriveExport(rest string) (driveEvent, bool) {
+	if !strings.HasSuffix(rest, "'") {
+		return driveEvent{}, false
+	}
+	rest = rest[:len(rest)-1]
+	const separator = "' to '"
+	var candidates []driveEvent
+	for i := strings.Index(rest, separator); i >= 0; {
+		candidates = append(candidates, driveEvent{Kind: driveEventExported, Path: rest[:i], Destination: rest[i+len(separator):]})
+		next := strings.Index(rest[i+1:], separator)
+		if next < 0 {
+			break
+		}
+		i += 1 + next
+	}
+	if len(candidates) == 0 {
+		return driveEvent{}, false
+	}
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate.Destination, candidate.Path+"_exports/") {
+			return candidate, true
+		}
+	}
+	return candidates[len(candidates)-1], true
+}
+
+// Where drive puts the docx export of a remote document
+func driveExportPath(driveSyncDirectory string, remotePath string) string {
+	return path.Join(driveSyncDirectory, remotePath+"_exports", path.Base(remotePath)+".docx")
+}
+
+// Whether a remote path is one of the _exports directories drive manages itself
+func isDriveExportPath(remotePath string) bool {
+	for _, element := range strings.Split(remotePath, "/") {
+		if strings.HasSuffix(element, "_exports") {
+			return true
+		}
+	}
+	return false
+}
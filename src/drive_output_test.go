@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Read a transcript of a real drive pull from the examples
+func driveTranscript(t *testing.T, name string) string {
+	contents, err := ioutil.ReadFile("../docs/examples/drive_output/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+// The events of a kind, as "<path> -> <destination>" or "<path>: <message>"
+func driveEventsOf(events []driveEvent, kind driveEventKind) (summary []string) {
+	for _, event := range events {
+		if event.Kind != kind {
+			continue
+		}
+		switch kind {
+		case driveEventExported:
+			summary = append(summary, event.Path+" -> "+event.Destination)
+		case driveEventError:
+			summary = append(summary, event.Path+": "+event.Message)
+		default:
+			summary = append(summary, event.Path)
+		}
+	}
+	return summary
+}
+
+func TestParseDriveOutputInitialPull(t *testing.T) {
+	events := parseDriveOutput(driveTranscript(t, "initial_test.md"))
+	added := driveEventsOf(events, driveEventAdded)
+	if len(added) != 13 || added[0] != "/The_Quest/WEB_STUFF/TEST_DOCUMENTS_FOR_DRIVERAKER" || added[12] != "/The_Quest/WEB_STUFF/TEST_DOCUMENTS_FOR_DRIVERAKER/divisible/divisible.jpg" {
+		t.Errorf("added %q", added)
+	}
+	const root = "/home/deleuze/.test_drive_sync/The_Quest/WEB_STUFF/TEST_DOCUMENTS_FOR_DRIVERAKER/"
+	// Exports that follow a progress bar on the same line are found too
+	want := []string{
+		root + "sds_article/get_paid_learn_to_code -> " + root + "sds_article/get_paid_learn_to_code_exports/get_paid_learn_to_code.docx",
+		root + "relo_article -> " + root + "relo_article_exports/relo_article.docx",
+		root + "default_google_drive/default_google_drive -> " + root + "default_google_drive/default_google_drive_exports/default_google_drive.docx",
+		root + "template/template -> " + root + "template/template_exports/template.docx",
+		root + "article_template/article_template.docx -> " + root + "article_template/article_template.docx_exports/article_template.docx.docx",
+		root + "divisible/divisible -> " + root + "divisible/divisible_exports/divisible.docx",
+	}
+	if got := driveEventsOf(events, driveEventExported); !reflect.DeepEqual(got, want) {
+		t.Errorf("exported\n%q\nwant\n%q", got, want)
+	}
+	if errors := driveEventsOf(events, driveEventError); len(errors) > 0 {
+		t.Errorf("errors in a clean pull: %q", errors)
+	}
+}
+
+func TestParseDriveOutputModifiedDocument(t *testing.T) {
+	events := parseDriveOutput(driveTranscript(t, "modified_document_test.md"))
+	const remote = "/The_Quest/WEB_STUFF/TEST_DOCUMENTS_FOR_DRIVERAKER/article_template/"
+	const local = "/home/deleuze/drivetemp" + remote
+	if got, want := driveEventsOf(events, driveEventModified), []string{remote + "article_template"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("modified %q, want %q", got, want)
+	}
+	if got, want := driveEventsOf(events, driveEventDeleted), []string{remote + "article_template_exports", remote + "article_template_exports/article_template.docx"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deleted %q, want %q", got, want)
+	}
+	if got, want := driveEventsOf(events, driveEventExported), []string{local + "article_template -> " + local + "article_template_exports/article_template.docx"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("exported %q, want %q", got, want)
+	}
+	// The localDelete line after a progress bar and the err: summary at the end
+	want := []string{
+		local + "article_template_exports: remove " + local + "article_template_exports: directory not empty",
+		remote + "article_template_exports: remove " + local + "article_template_exports: directory not empty",
+	}
+	if got := driveEventsOf(events, driveEventError); !reflect.DeepEqual(got, want) {
+		t.Errorf("errors\n%q\nwant\n%q", got, want)
+	}
+	changes := interpretDriveOutput(driveTranscript(t, "modified_document_test.md"), "/home/deleuze/drivetemp/")
+	if got, want := changeSummary(changes), []string{"modified The_Quest/WEB_STUFF/TEST_DOCUMENTS_FOR_DRIVERAKER/article_template/article_template_exports/article_template.docx The_Quest/WEB_STUFF/TEST_DOCUMENTS_FOR_DRIVERAKER/article_template/article_template_exports/article_template.docx"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("changes %q, want %q, the _exports deletions are drive's own", got, want)
+	}
+}
+
+func TestParseDriveOutputAwkwardPaths(t *testing.T) {
+	transcript := "Resolving...\r\n" +
+		"+ /News/Café crème\r\n" +
+		"M /News/Bob's \"big\" day\r\n" +
+		"- /News/Old story\r\n" +
+		" 0 / 10 [-----]   0.00% 10 / 10 [=====] 100.00% 1sExported '/sync/News/Café crème' to '/sync/News/Café crème_exports/Café crème.docx'\r\n" +
+		"Exported '/sync/News/Bob's \"big\" day' to '/sync/News/Bob's \"big\" day_exports/Bob's \"big\" day.docx'\n" +
+		"Exported '/sync/News/It' to 'me' to '/sync/News/It' to 'me_exports/It' to 'me.docx'\n" +
+		"\r 5 / 10 [==>--]  50.00%localDelete: \"/sync/News/Say \\\"hi\\\"_exports\" remove /sync/News/Say \"hi\"_exports: permission denied\n" +
+		"localDelete: not quoted at all\n" +
+		"/News/日本語 記事 err: the export failed\n" +
+		"Deletion count 1\n"
+	events := parseDriveOutput(transcript)
+	if got, want := driveEventsOf(events, driveEventAdded), []string{"/News/Café crème"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("added %q, want %q", got, want)
+	}
+	if got, want := driveEventsOf(events, driveEventModified), []string{"/News/Bob's \"big\" day"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("modified %q, want %q", got, want)
+	}
+	if got, want := driveEventsOf(events, driveEventDeleted), []string{"/News/Old story"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deleted %q, want %q", got, want)
+	}
+	want := []string{
+		"/sync/News/Café crème -> /sync/News/Café crème_exports/Café crème.docx",
+		"/sync/News/Bob's \"big\" day -> /sync/News/Bob's \"big\" day_exports/Bob's \"big\" day.docx",
+		"/sync/News/It' to 'me -> /sync/News/It' to 'me_exports/It' to 'me.docx",
+	}
+	if got := driveEventsOf(events, driveEventExported); !reflect.DeepEqual(got, want) {
+		t.Errorf("exported\n%q\nwant\n%q", got, want)
+	}
+	want = []string{
+		"/sync/News/Say \"hi\"_exports: remove /sync/News/Say \"hi\"_exports: permission denied",
+		": localDelete: not quoted at all",
+		"/News/日本語 記事: the export failed",
+	}
+	if got := driveEventsOf(events, driveEventError); !reflect.DeepEqual(got, want) {
+		t.Errorf("errors\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestDriveExportPath(t *testing.T) {
+	if got, want := driveExportPath("/sync/", "/News/Café crème"), "/sync/News/Café crème_exports/Café crème.docx"; got != want {
+		t.Errorf("export path %q, want %q", got, want)
+	}
+	for remotePath, want := range map[string]bool{
+		"/News/Story_exports":             true,
+		"/News/Story_exports/Story.docx":  true,
+		"/News/Story":                     false,
+		"/News/exports of the week/Story": false,
+	} {
+		if isDriveExportPath(remotePath) != want {
+			t.Errorf("isDriveExportPath(%q) is %v", remotePath, !want)
+		}
+	}
+}
+
+func TestInterpretDriveOutputDatesDocuments(t *testing.T) {
+	syncDirectory := t.TempDir() + "/"
+	exportPath := syncDirectory + "News/Story_exports/Story.docx"
+	modified := time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)
+	err := os.MkdirAll(filepath.Dir(exportPath), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(exportPath, []byte("docx"), 0644)
+	}
+	if err == nil {
+		err = os.Chtimes(exportPath, modified, modified)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := interpretDriveOutput("Exported '"+syncDirectory+"News/Story' to '"+exportPath+"'\n", syncDirectory)
+	if len(changes) != 1 || !changes[0].Document.Modified.Equal(modified) {
+		t.Fatalf("changes %+v, want the document modified at %v", changes, modified)
+	}
+
+	// The first modification time stays the creation time
+	manifest := NewManifest()
+	configuration := Configuration{HugoPostDirectory: t.TempDir() + "/"}
+	trackArticle(manifest, changes[0].Document, configuration)
+	changes[0].Document.Modified = modified.Add(time.Hour)
+	trackArticle(manifest, changes[0].Document, configuration)
+	entry := manifest.Documents[changes[0].Document.ID]
+	if !entry.SourceCreated.Equal(modified) || !entry.SourceModified.Equal(modified.Add(time.Hour)) {
+		t.Errorf("created %v and modified %v, want %v and an hour later", entry.SourceCreated, entry.SourceModified, modified)
+	}
+}
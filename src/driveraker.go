@@ -3,171 +3,18 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
 	"fmt"
-	"hash/adler32"
-	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"os/user"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 )
 
-/*
-Hashtable code forked from
-https://github.com/jackfhebert/hashtable
-*/
-
-// Not publicly visible since it is our internal wrapper.
-type linkedListNode struct {
-	// The value of this node.
-	// Once I figure out interfaces, that will go here.
-	Value interface{} `json:"Value"`
-	// Pointer to the next node in the list.
-	Next *linkedListNode `json:"Next"`
-}
-
-// Exposed - this is the struct to use.
-type LinkedList struct {
-	// The first node in the list.
-	First *linkedListNode `json:"First"`
-	// The last item in the list.
-	// This makes adding to the list fast, but isn't strictly
-	// needed.
-	Last *linkedListNode `json:"Last"`
-	// How many items are in the list. This is mostly
-	// for the size helper and not strictly needed.
-	Size int `json:"Size"`
-}
-
-func NewLinkedList() *LinkedList {
-	return &LinkedList{nil, nil, 0}
-}
-
-func (list *LinkedList) SizeOf() int {
-	return list.Size
-}
-
-func (list *LinkedList) AddItem(item interface{}) {
-	list.Size += 1
-	node := &linkedListNode{item, nil}
-	if list.First == nil {
-		list.First = node
-	}
-	if list.Last != nil {
-		list.Last.Next = node
-	}
-	list.Last = node
-}
-
-func (list *LinkedList) RemoveItem(item interface{}) {
-	// Track the previous node from the iterator for updating
-	// pointers between nodes.
-	var prevNode *linkedListNode
-	prevNode = nil
-	for currNode := list.First; currNode != nil; currNode = currNode.Next {
-		if currNode.Value == item {
-			// Update the list metadata.
-			list.Size -= 1
-			if currNode == list.First {
-				list.First = currNode.Next
-			}
-			if currNode == list.Last {
-				list.Last = prevNode
-			}
-			// Update the nodes.
-			if prevNode != nil {
-				prevNode.Next = currNode.Next
-			}
-
-			// All done here.
-			return
-		}
-
-		// Keep iterating through the list. I could probably assign
-		// this in the for-loop definition above.
-		prevNode = currNode
-	}
-}
-
-func (list *LinkedList) Items() []*interface{} {
-	items := make([]*interface{}, list.Size)
-
-	for i, currNode := 0, list.First; currNode != nil; currNode = currNode.Next {
-		items[i] = &currNode.Value
-		i += 1
-	}
-	return items
-}
-
-var (
-	fillRate int = 10
-)
-
-type HashTable struct {
-	// Number of items in table
-	Size int `json:"Size"`
-	// Maximum number of items in table
-	Capacity int `json:"Capacity"`
-	// Array of linkedlist pointers
-	Items []*LinkedList `json:"Items"`
-}
-
-// Internal helper to wrap the key and value which were added to
-// the hashtable. This is the value stored in the linked lists
-// per bucket.
-type tableItem struct {
-	Key   string      `json:"Key"`
-	Value interface{} `json:"Value"`
-}
-
-// Create a new hashtable with a given number of buckets. This
-// probably should have been made to specify the capacity instead.
-func NewHashTableSized(size int) *HashTable {
-	table := &HashTable{0, fillRate * size, make([]*LinkedList, size)}
-	for i := 0; i < len(table.Items); i++ {
-		table.Items[i] = nil
-	}
-	return table
-}
-
-// Return a default hashtable.
-func NewHashTable() *HashTable {
-	return NewHashTableSized(128)
-}
-
-// Make the hashtable bigger so that there are fewer items per bucket.
-// This takes up more memory (ish) but reduces the number of items per
-// bucket which makes the datastructure faster to use.
-func (table *HashTable) resizeTable() {
-	next := NewHashTableSized(2 * len(table.Items))
-	for _, list := range table.Items {
-		if list != nil {
-			for _, item := range list.Items() {
-				if parsed, ok := (*item).(tableItem); ok {
-					next.AddItem(parsed.Key, parsed.Value)
-				} else {
-					fmt.Println("failed to parse item in resize", item)
-				}
-			}
-		}
-	}
-	table = next
-}
-
-// Helper function to take the key string and determine which bucket
-// the item should be placed in.
-func getIndex(key string, max int) int {
-	hash := adler32.New()
-	hash.Write([]byte(key))
-	digest := hash.Sum32()
-	return int(digest) % max
-}
-
 // Shorten the values for paths by getting rid of the DriveSyncDirectory string
 func shortenPath(fullpath, DriveSyncDirectory string) string {
 	r := strings.NewReplacer(DriveSyncDirectory, "")
@@ -175,130 +22,6 @@ func shortenPath(fullpath, DriveSyncDirectory string) string {
 	return relativePath
 }
 
-// Add a key, value paid to the hash table.
-func (table *HashTable) AddItem(key string, value interface{}) {
-	index := getIndex(key, len(table.Items))
-	if table.Items[index] == nil {
-		table.Items[index] = NewLinkedList()
-	}
-	table.Size += 1
-	table.Items[index].AddItem(tableItem{key, value})
-	if table.Size > table.Capacity {
-		table.resizeTable()
-	}
-}
-
-// Remove all instances of a key from the table.
-func (table *HashTable) RemoveKey(key string) bool {
-	index := getIndex(key, len(table.Items))
-	if table.Items[index] != nil {
-		for _, item := range table.Items[index].Items() {
-			if parsed, ok := (*item).(tableItem); ok {
-				if parsed.Key == key {
-					table.Items[index].RemoveItem(item)
-					table.Size -= 1
-				}
-			}
-		}
-	}
-	return false
-}
-
-// Determine if a key is contained in the hash table.
-func (table *HashTable) ContainsKey(key string) bool {
-	fmt.Println("Checking for key:", key)
-	index := getIndex(key, len(table.Items))
-	if table.Items[index] != nil {
-		for _, item := range table.Items[index].Items() {
-			if parsed, ok := (*item).(tableItem); ok {
-				if parsed.Key == key {
-					fmt.Println(parsed.Key)
-					return true
-				}
-			} else {
-				fmt.Println("failed to parse item in contains", *item)
-			}
-		}
-	}
-	return false
-}
-
-func (table *HashTable) GetValue(key string) interface{} {
-	fmt.Println("Checking for key:", key)
-	index := getIndex(key, len(table.Items))
-	if table.Items[index] != nil {
-		for _, item := range table.Items[index].Items() {
-			if parsed, ok := (*item).(tableItem); ok {
-				if parsed.Key == key {
-					return parsed.Value
-				}
-			} else {
-				fmt.Println("failed to parse item in contains", *item)
-			}
-		}
-	}
-	return nil
-}
-
-func (table *HashTable) SaveHashTable(filePath string) {
-	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0666)
-	if err != nil {
-		fmt.Println("[ERROR] Error opening hashtable file: ", err)
-	}
-	defer f.Close()
-	b, err := json.Marshal(table)
-	if err != nil {
-		fmt.Println("[ERROR] Error saving hashtable as JSON: ", err)
-	}
-	f.Write(b)
-	f.Close()
-}
-
-func ReadHashTable(filePath string) (table *HashTable) {
-	hashtable, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		fmt.Println("[ERROR] Error opening hashtable: ", err)
-	}
-	err = json.Unmarshal(hashtable, &table)
-	if err != nil {
-		fmt.Println("[ERROR] Error reading hashtable: ", err)
-	}
-	return table
-}
-
-/*
-End of forked Hashtable code
-*/
-
-// The configuration file struct
-type Configuration struct {
-	DriveSyncDirectory         string
-	GoogleDriveRemoteDirectory string
-	HugoPostDirectory          string
-	ProductionDirectory        string
-	HashtablePath              string
-}
-
-// Read the configuration JSON file in order to get some settings and directories
-func readConfig(filename string, conf *sync.WaitGroup, confMessage chan string) {
-	fmt.Println("Reading configuration...")
-	file, _ := os.Open(filename)
-	decoder := json.NewDecoder(file)
-	configuration := Configuration{}
-	err := decoder.Decode(&configuration)
-	if err != nil {
-		fmt.Println("[ERROR] Error reading the JSON confguration: ", err)
-		return
-	}
-	confMessage <- fmt.Sprintf(configuration.DriveSyncDirectory)
-	confMessage <- fmt.Sprintf(configuration.GoogleDriveRemoteDirectory)
-	confMessage <- fmt.Sprintf(configuration.HugoPostDirectory)
-	confMessage <- fmt.Sprintf(configuration.ProductionDirectory)
-	confMessage <- fmt.Sprintf(configuration.HashtablePath)
-	fmt.Println("Finished reading configuration!")
-	conf.Done()
-}
-
 // exists returns whether the given file or directory exists or not
 func exists(path string) (bool, error) {
 	_, err := os.Stat(path)
@@ -311,119 +34,203 @@ func exists(path string) (bool, error) {
 	return true, err
 }
 
-// Sync google drive remote folder to the configured local directory.
-// Then send the output from drive CLI to a function to intepret the output
-// by stripping the full output down to an array of string paths to docx files.
-func syncGoogleDrive(syncDirectory string, driveRemoteDirectory string, databasePath string, driveSync *sync.WaitGroup, docxPathsMessage chan []string) {
-	syncGDrive := new(sync.WaitGroup)
-	output := make(chan string)
-	filePaths := make(chan []string)
-	sync := exec.Command("/usr/bin/drive", "pull", "-no-prompt", "-desktop-links=false", "-export", "docx", driveRemoteDirectory)
-	sync.Dir = syncDirectory
-	fmt.Println("Syncing Google Drive...")
-	out, err := sync.Output()
+// Sync the configured source and record what changed in the manifest.
+// Documents whose export hashes the same as when they were last converted are left alone,
+// the rest wait in the manifest until they are converted.
+func syncGoogleDrive(source Source, manifest *Manifest, configuration Configuration, driveSync *sync.WaitGroup, syncMessage chan error) {
+	changes, cursor, err := source.Changes(manifest.Cursor)
 	if err != nil {
-		fmt.Println("[ERROR] Error syncing Google Drive: ", err)
+		syncMessage <- err
+		driveSync.Done()
 		return
 	}
-	fmt.Printf("drive: " + string(out))
-	fmt.Println("Done syncing!")
-	syncGDrive.Add(1)
-	go interpretDriveOutput(syncGDrive, databasePath, syncDirectory, output, filePaths)
-	output <- string(out)
-	docxPaths := <-filePaths
-	syncGDrive.Wait()
-	docxPathsMessage <- docxPaths
+	fmt.Println("Looking for changed documents...")
+	// Exports that failed last time are fetched again, the cursor has moved past their changes
+	changes = append(changes, manifest.unfetchedChanges(changes)...)
+	for _, change := range changes {
+		document := change.Document
+		if change.Kind == ChangeDeleted {
+			// A document driveraker never synced has no article to take down
+			entry := manifest.Documents[document.ID]
+			if entry == nil {
+				continue
+			}
+			entry.Deleted = true
+			entry.Unfetched = nil
+			entry.FetchError = ""
+			continue
+		}
+		exportPath, err := source.FetchExport(document)
+		if err != nil {
+			fmt.Println("[ERROR] Error fetching "+document.Path+", trying again on the next sync: ", err)
+			manifest.markUnfetched(document, err)
+			continue
+		}
+		document.ExportPath = exportPath
+		hash, err := hashFile(exportPath)
+		if err != nil {
+			fmt.Println("[ERROR] Error hashing "+exportPath+", trying again on the next sync: ", err)
+			manifest.markUnfetched(document, err)
+			continue
+		}
+		entry := trackArticle(manifest, document, configuration)
+		entry.ExportPath = exportPath
+		entry.ExportSHA256 = hash
+		entry.Unfetched = nil
+		entry.FetchError = ""
+		if !entry.Pending() {
+			fmt.Println("Already up to date: " + document.Path)
+		}
+	}
+	manifest.Cursor = cursor
+	syncMessage <- nil
 	driveSync.Done()
 }
 
-// Look up paths in hashtable
-// Already in hashtable, then remove from the array
-// Unless it is a modified document
-// Otherwise add the new paths to the hashtable and forward them back to the main function
-func alreadySyncedAndCompiled(matches []string, driveSyncDirectory string, hashTablePath string) []string {
-	var hashTable *HashTable
-	fmt.Println("Checking if hashtable already exists...")
-	hashTableExists, err := exists(hashTablePath)
-	// if a hashtable does not exist then make a new one
-	if hashTableExists == false {
-		if err != nil {
-			fmt.Println("[ERROR] Error checking for hashtable: ", err)
+// Work out where a document's article goes and record it in the manifest under the document's ID.
+// When the URL changed because the document was renamed or moved to another section the old URL becomes an alias.
+func trackArticle(manifest *Manifest, document Document, configuration Configuration) *ManifestEntry {
+	hugoPostDirectory := configuration.HugoPostDirectory
+	entry := manifest.Documents[document.ID]
+	if entry == nil {
+		entry = &ManifestEntry{}
+		manifest.Documents[document.ID] = entry
+	}
+	// Entries from before sections were configurable are all articles
+	if entry.Slug != "" && entry.Section == "" {
+		entry.Section = "articles"
+	}
+	section := documentSection(document, configuration)
+	slug := uniqueSlug(manifest, articleSlug(document), document.ID)
+	markdownPath := slugMarkdownPath(slug, section, configuration.ArticleLayout, hugoPostDirectory)
+	url := slugURL(slug, section)
+	previousMarkdownPath := ""
+	previousURL := ""
+	if entry.Slug != "" {
+		previousMarkdownPath = entry.MarkdownPath
+		if previousMarkdownPath == "" {
+			previousMarkdownPath = slugMarkdownPath(entry.Slug, entry.Section, "file", hugoPostDirectory)
+		}
+		// Switching between files and page bundles moves the article but keeps its URL
+		if previousMarkdownPath == markdownPath {
+			previousMarkdownPath = ""
+		}
+		if slugURL(entry.Slug, entry.Section) != url {
+			previousURL = slugURL(entry.Slug, entry.Section)
 		}
-		hashTable = NewHashTableSized(len(matches))
 	} else {
-		// try to open the already existing hashtable
-		hashTable = ReadHashTable(hashTablePath)
-	}
-	fmt.Println("Looking for already synced documents...")
-	var alreadySynced bool
-	matchesLength := len(matches)
-	for i := 0; i < matchesLength; i++ {
-		alreadySynced = hashTable.ContainsKey(shortenPath(matches[i], driveSyncDirectory))
-		if alreadySynced == true {
-			matches = append(matches[:i], matches[i+1:]...)
-			matchesLength = len(matches)
-			i--
-		} else {
-			hashTable.AddItem(shortenPath(matches[i], driveSyncDirectory), shortenPath(matches[i], driveSyncDirectory))
+		// Documents synced before slugs were recorded live under their docx name
+		legacyPath := legacyArticleMarkdownPath(document.ExportPath, hugoPostDirectory)
+		if legacyExists, _ := exists(legacyPath); legacyExists && legacyPath != markdownPath {
+			previousMarkdownPath = legacyPath
+			previousURL = "/articles/" + strings.ToLower(strings.TrimSuffix(path.Base(legacyPath), ".md")) + "/"
 		}
 	}
-	hashTable.SaveHashTable(hashTablePath)
-	return matches
-}
-
-// Find all modified documents and make sure to compile them by adding them to a string array
-func findModifiedDocuments(result string) (modifiedDocuments []string) {
-	fmt.Println("Looking for modified documents...")
-	re := regexp.MustCompile(`M (\/.*)`)
-	values := re.FindAllString(result, -1)
-	var i int
-	for i = 0; i < len(values); i++ {
-		value := fmt.Sprintf("%f", values[0])
-		value = strings.Replace(value, `%!f(string=M `, ``, -1)
-		value = strings.Replace(value, `)`, ``, -1)
-		filename := value[strings.LastIndex(value, "/"):len(value)]
-		value = value + "_exports" + filename + ".docx"
-		modifiedDocuments = append(modifiedDocuments, value)
-	}
-	return modifiedDocuments
+	var aliases []string
+	for _, alias := range entry.Aliases {
+		// A document renamed back to an old name takes its URL back
+		if alias != url {
+			aliases = append(aliases, alias)
+		}
+	}
+	if previousURL != "" {
+		fmt.Println("Renamed " + previousURL + " to " + url)
+		aliases = append(aliases, previousURL)
+	}
+	// Renamed again before the article was converted, the first markdown file is still the one to remove
+	if entry.PreviousMarkdownPath == "" {
+		entry.PreviousMarkdownPath = previousMarkdownPath
+	}
+	// Moving a document between status folders changes its article even though the docx stays the same
+	folderStatus := documentFolderStatus(document, configuration)
+	if entry.FolderStatus != "" && entry.FolderStatus != folderStatus {
+		entry.ContentSHA256 = ""
+	}
+	entry.FolderStatus = folderStatus
+	entry.SourcePath = document.Path
+	// Documents moved along with their folder come without a modification time
+	if !document.Modified.IsZero() {
+		entry.SourceModified = document.Modified
+	}
+	if !document.Created.IsZero() {
+		entry.SourceCreated = document.Created
+	} else if entry.SourceCreated.IsZero() && !document.Modified.IsZero() {
+		// Sources that cannot tell when a document was created, like the drive CLI, give the time it was
+		// first seen, so editing the document later does not move its publication date
+		entry.SourceCreated = document.Modified
+	}
+	entry.Slug = slug
+	entry.Section = section
+	entry.Aliases = aliases
+	entry.MarkdownPath = markdownPath
+	entry.Deleted = false
+	return entry
+}
+
+// Number a slug when another document already has it
+func uniqueSlug(manifest *Manifest, slug string, id string) string {
+	taken := make(map[string]bool)
+	for otherID, entry := range manifest.Documents {
+		if otherID != id {
+			taken[entry.Slug] = true
+		}
+	}
+	unique := slug
+	for i := 2; taken[unique]; i++ {
+		unique = fmt.Sprintf("%s-%d", slug, i)
+	}
+	return unique
 }
 
-// Find all Exported file paths via a regex expression and then add them to an array
-func interpretDriveOutput(syncGDrive *sync.WaitGroup, hashtablePath string, driveSyncDirectory string, output chan string, filePaths chan []string) {
+// Turn the events of a drive pull into changes for the drive CLI source
+func interpretDriveOutput(results string, driveSyncDirectory string) (changes []Change) {
 	fmt.Println("Interpreting command line output...")
-	results := <-output
-	re := regexp.MustCompile(`[^'](?:to ')(.*?)'`)
-	matches := re.FindAllString(results, -1)
-	// Make the matches into actual strings
-	for i := 0; i < len(matches); i++ {
-		match := matches[i]
-		match = strings.Replace(match, ` to '`, ``, -1)
-		match = strings.Replace(match, `docx'`, `docx`, -1)
-		matches[i] = match
-	}
-	// Lookup entries in hashtable
-	newMatches := alreadySyncedAndCompiled(matches, driveSyncDirectory, hashtablePath)
-	// Find modified documents and add them to the docx paths
-	modifiedDocuments := findModifiedDocuments(results)
-	newMatches = append(newMatches, modifiedDocuments...)
-	// Send the list of files to convert and append hugo front-matter back to the main thread
-	fmt.Printf("File paths: %s \n", newMatches)
-	filePaths <- newMatches
+	events := parseDriveOutput(results)
+	// Modified documents are reported by their remote path, their exports show up as Exported events too
+	modified := make(map[string]bool)
+	for _, event := range events {
+		if event.Kind == driveEventModified {
+			modified[path.Join(driveSyncDirectory, event.Path)] = true
+		}
+	}
+	for _, event := range events {
+		switch event.Kind {
+		case driveEventExported:
+			kind := ChangeAdded
+			if modified[event.Path] {
+				kind = ChangeModified
+			}
+			changes = append(changes, Change{kind, driveCLIDocument(event.Destination, driveSyncDirectory)})
+		case driveEventDeleted:
+			// drive clears out stale _exports directories itself, those are not documents
+			if isDriveExportPath(event.Path) {
+				continue
+			}
+			changes = append(changes, Change{ChangeDeleted, driveCLIDocument(driveExportPath(driveSyncDirectory, event.Path), driveSyncDirectory)})
+		case driveEventError:
+			fmt.Println("[ERROR] drive: " + event.Path + ": " + event.Message)
+		}
+	}
 	fmt.Println("Done!")
-	syncGDrive.Done()
+	return changes
 }
 
-// Convert from docx to markdown with pandoc
-func convertToMarkdownWithPandoc(docxFilePath string, markdownFilePath string, pandoc *sync.WaitGroup) {
-	convert := exec.Command("/usr/bin/pandoc", "--atx-headers", "--smart", "--normalize", "--email-obfuscation=references", "--mathjax", "-t", "markdown_strict", "-o", markdownFilePath, docxFilePath)
-	convert.Dir = "/"
-	out, err := convert.CombinedOutput()
-	if err != nil {
-		fmt.Println("[ERROR] Error converting files to markdown with pandoc: ", err)
+// Describe a docx exported by the drive CLI. The export's path is its ID, see driveCLISource, and its
+// modification time stands in for the document's, the drive CLI does not say when a document was created.
+func driveCLIDocument(exportPath string, driveSyncDirectory string) Document {
+	relativePath := shortenPath(exportPath, driveSyncDirectory)
+	document := Document{ID: relativePath, Path: relativePath, ExportPath: exportPath}
+	if info, err := os.Stat(exportPath); err == nil {
+		document.Modified = info.ModTime()
 	}
-	fmt.Println("pandoc: ", out)
-	pandoc.Done()
+	return document
+}
+
+// Where the article for a docx file went before articles were named by slug
+func legacyArticleMarkdownPath(docxFilePath string, hugoPostDirectory string) string {
+	nameRegex := regexp.MustCompile(`(\w+)(?:.docx)`)
+	name := nameRegex.FindString(docxFilePath)
+	return hugoPostDirectory + "content/articles/" + name + ".md"
 }
 
 /*
@@ -461,30 +268,20 @@ func (m *MarkdownFileRecord) readMarkdownLines() error {
 	return nil
 }
 
+// Write the content ahead of the file's lines, replacing the file atomically
 func (m *MarkdownFileRecord) Prepend(content []string) error {
 	err := m.readMarkdownLines()
 	if err != nil {
 		return err
 	}
-	f, err := os.OpenFile(m.Filename, os.O_CREATE|os.O_WRONLY, 0600)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	writer := bufio.NewWriter(f)
+	var buffer bytes.Buffer
 	for i := 0; i < len(content); i++ {
-		writer.WriteString(fmt.Sprintf("%s\n", content[i]))
+		buffer.WriteString(fmt.Sprintf("%s\n", content[i]))
 	}
 	for _, line := range m.Contents {
-		_, err := writer.WriteString(fmt.Sprintf("%s\n", line))
-		if err != nil {
-			return err
-		}
-	}
-	if err := writer.Flush(); err != nil {
-		return err
+		buffer.WriteString(fmt.Sprintf("%s\n", line))
 	}
-	return nil
+	return writeFileAtomic(m.Filename, buffer.Bytes(), 0644)
 }
 
 func prependWrapper(content []string, markdownFilePath string, prepend *sync.WaitGroup) {
@@ -497,71 +294,29 @@ func prependWrapper(content []string, markdownFilePath string, prepend *sync.Wai
 
 /*
 End of modified record.go code.
-
-Beginning of forked popline.go code from:
-https://stackoverflow.com/questions/30940190/remove-first-line-from-text-file-in-golang#30948278
 */
 
-func deleteLine(f *os.File) ([]byte, error) {
-	fi, err := f.Stat()
-	if err != nil {
-		return nil, err
-	}
-	buf := bytes.NewBuffer(make([]byte, 0, fi.Size()))
-	_, err = f.Seek(0, os.SEEK_SET)
-	if err != nil {
-		return nil, err
-	}
-	_, err = io.Copy(buf, f)
-	if err != nil {
-		return nil, err
-	}
-	line, err := buf.ReadString('\n')
-	if err != nil && err != io.EOF {
-		return nil, err
-	}
-	_, err = f.Seek(0, os.SEEK_SET)
-	if err != nil {
-		return nil, err
-	}
-	nw, err := io.Copy(f, buf)
-	if err != nil {
-		return nil, err
-	}
-	err = f.Truncate(nw)
-	if err != nil {
-		return nil, err
-	}
-	err = f.Sync()
-	if err != nil {
-		return nil, err
-	}
-	_, err = f.Seek(0, os.SEEK_SET)
-	if err != nil {
-		return nil, err
-	}
-	return []byte(line), nil
-}
-
+// Remove the first line of a file, replacing the file atomically
 func deleteLineWrapper(markdownFilePath string, deleteline *sync.WaitGroup) {
-	f, err := os.OpenFile(markdownFilePath, os.O_RDWR|os.O_CREATE, 0666)
+	input, err := ioutil.ReadFile(markdownFilePath)
 	if err != nil {
 		fmt.Println("[ERROR] Error opening file: ", err)
+		deleteline.Done()
+		return
 	}
-	defer f.Close()
-	line, err := deleteLine(f)
+	line := input
+	rest := []byte{}
+	if i := bytes.IndexByte(input, '\n'); i >= 0 {
+		line, rest = input[:i+1], input[i+1:]
+	}
+	err = writeFileAtomic(markdownFilePath, rest, 0644)
 	if err != nil {
 		fmt.Println("[ERROR] Error deleting a line: ", err)
 	}
 	fmt.Printf("Deleted line: %s from %s\n", string(line), markdownFilePath)
-	f.Close()
 	deleteline.Done()
 }
 
-/*
-End of modified popline.go code
-*/
-
 // Rewrite a line in a file
 func rewriteMarkdownLine(line int, replacement string, markdownFilePath string, rewritemarkdown *sync.WaitGroup) {
 	input, err := ioutil.ReadFile(markdownFilePath)
@@ -571,141 +326,157 @@ func rewriteMarkdownLine(line int, replacement string, markdownFilePath string,
 	contents := strings.Split(string(input), "\n")
 	contents[line] = replacement
 	output := strings.Join(contents, "\n")
-	err = ioutil.WriteFile(markdownFilePath, []byte(output), 0644)
+	err = writeFileAtomic(markdownFilePath, []byte(output), 0644)
 	if err != nil {
 		fmt.Println("[ERROR] There was an error writing the file")
 	}
 	rewritemarkdown.Done()
 }
 
-// General function for regex
-func regexLineOfMarkdown(contents []string, regex string, variable string, line int) (value []string, lineNumber int) {
-	if strings.Index(contents[line], variable) >= 0 {
-		re := regexp.MustCompile(regex)
-		value = re.FindAllString(contents[line], -1)
-		// if we find it, move down a line
-		lineNumber = line + 2
-		return
+// Find a line of the article's heading, skipping blank lines. When the line starts with marker
+// return the text after it and the line after it, otherwise stay on line.
+func metadataLine(contents []string, marker string, line int) (value string, lineNumber int, found bool) {
+	next := line
+	for next < len(contents) && strings.TrimSpace(contents[next]) == "" {
+		next++
 	}
-	value = append(value, "")
-	lineNumber = line
-	// didn't find anything, then leave blank and do not iterate the line number
-	return
+	if next >= len(contents) || !strings.HasPrefix(contents[next], marker) {
+		return "", line, false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(contents[next], marker)), next + 1, true
+}
+
+// The image at the top of an article, an <img> tag or a markdown image, and the line after it
+func coverImageLine(contents []string, line int) (source string, lineNumber int, found bool) {
+	for _, marker := range []string{"<img ", "!["} {
+		if value, next, found := metadataLine(contents, marker, line); found {
+			return imageSource(marker + value), next, true
+		}
+	}
+	return "", line, false
+}
+
+// pandoc escapes markdown characters such as \_ and \[, front matter wants the plain text
+var markdownEscapeRegex = regexp.MustCompile("\\\\([\\\\`*_{}\\[\\]()#+\\-.!<>|~])")
+
+func unescapeMarkdown(text string) string {
+	return markdownEscapeRegex.ReplaceAllString(text, "$1")
+}
+
+// Split a comma separated list such as the tags, leaving out empty items
+func splitList(text string) (items []string) {
+	for _, item := range strings.Split(unescapeMarkdown(text), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// The names on a byline such as "By Jane Doe, John Roe and Ann Poe"
+func splitByline(byline string) []string {
+	byline = strings.TrimPrefix(strings.TrimSpace(byline), "By ")
+	byline = strings.Replace(byline, ", and ", ", ", -1)
+	byline = strings.Replace(byline, " and ", ", ", -1)
+	return splitList(byline)
 }
 
 // Read markdown document and write the hugo headers to the beginning of the document
-func readMarkdownWriteHugoHeaders(markdownFilePath string, docxFilePath string, hugoDirectory string, productionDirectory string, front_matter *sync.WaitGroup) {
+// Documents with metadata that cannot be published, such as an impossible date, send an error on frontMatterMessage
+// and are left without front matter, every other document sends nil.
+func readMarkdownWriteHugoHeaders(markdownFilePath string, article Article, configuration Configuration, front_matter *sync.WaitGroup, frontMatterMessage chan error) {
+	var headerErr error
+	defer front_matter.Done()
+	defer func() {
+		frontMatterMessage <- headerErr
+	}()
+	document := article.Document
+	docxFilePath := document.ExportPath
+	// The converter extracted the images of the docx next to the markdown file
+	mediaDirectory := docxMediaDirectory(markdownFilePath)
+	images := articleImageDestination(article.MarkdownPath, configuration.HugoPostDirectory)
 	markdownfile := NewMarkdownFile(markdownFilePath)
 	err := markdownfile.readMarkdownLines()
 	if err != nil {
 		fmt.Println("[ERROR] Error reading lines from the markdown file: ", err)
 	}
-	// Read and then rewrite the line read according to what value it should be
-	var i int                    // The number of driveraker front matter lines
-	i = 0                        // For the reading line, start at 0
-	var hugoFrontMatter []string // Add all hugo front matter to this string slice
-	hugoFrontMatter = append(hugoFrontMatter, "{")
-	// Find DRVRKR\_TAGS
-	var tags []string
-	tags, i = regexLineOfMarkdown(markdownfile.Contents, `[^\\\_:,\n]*?[^(DRVRKR\\\_TAGS)](\w+)`, "DRVRKR\\_TAGS", i)
-	tagsList := fmt.Sprintf("%f", tags)
-	tagsList = strings.Replace(tagsList, `%!f(string= `, `"`, -1)
-	tagsList = strings.Replace(tagsList, `) `, `", `, -1)
-	tagsList = strings.Replace(tagsList, `)`, `"`, -1)
-	tagsList = "    \"tags\": " + tagsList + ","
-	hugoFrontMatter = append(hugoFrontMatter, tagsList)
-	// Now find the DRVRKR\_CATEGORIES
-	var categories []string
-	categories, i = regexLineOfMarkdown(markdownfile.Contents, `[^\\\_:,\n]*?[^(DRVRKR\\\_CATEGORIES)](\w+)`, "DRVRKR\\_CATEGORIES", i)
-	categoriesList := fmt.Sprintf("%f", categories)
-	categoriesList = strings.Replace(categoriesList, `%!f(string= `, `"`, -1)
-	categoriesList = strings.Replace(categoriesList, `) `, `", `, -1)
-	categoriesList = strings.Replace(categoriesList, `)`, `"`, -1)
-	categoriesList = "    \"categories\": " + categoriesList + ","
-	hugoFrontMatter = append(hugoFrontMatter, categoriesList)
-	// Draft status
-	hugoFrontMatter = append(hugoFrontMatter, "    \"draft\": \"false\",")
-	// Now find the DRVRKR\_PUB\_DATE
-	var publicationyearmonthdate []string
-	publicationyearmonthdate, i = regexLineOfMarkdown(markdownfile.Contents, `[^\\\_:,\n]*?[^(DRVRKR\\\_PUB\\\_DATE)](\w+)`, "DRVRKR\\_PUB\\_DATE", i)
-	publicationDate := fmt.Sprintf("%f", publicationyearmonthdate)
-	publicationDate = strings.Replace(publicationDate, `%!f(string= `, ``, -1)
-	publicationDate = strings.Replace(publicationDate, `)`, ``, -1)
-	publicationDate = strings.Replace(publicationDate, `[`, `"`, -1)
-	publicationDate = strings.Replace(publicationDate, `]`, `"`, -1)
-	publicationDate = strings.Replace(publicationDate, ` `, `-`, -1)
-	hugoFrontMatter = append(hugoFrontMatter, "    \"date\": "+publicationDate+",")
-	hugoFrontMatter = append(hugoFrontMatter, "    \"publishDate\": "+publicationDate+",")
-	// Now find the DRVRKR\_UPDATE\_DATE
-	var updateyearmonthdate []string
-	updateyearmonthdate, i = regexLineOfMarkdown(markdownfile.Contents, `[^\\\_:,\n]*?[^(DRVRKR\\\_UPDATE\\\_DATE)](\w+)`, "DRVRKR\\_UPDATE\\_DATE", i)
-	modificationDate := fmt.Sprintf("%f", updateyearmonthdate)
-	modificationDate = strings.Replace(modificationDate, `%!f(string= `, ``, -1)
-	modificationDate = strings.Replace(modificationDate, `)`, ``, -1)
-	modificationDate = strings.Replace(modificationDate, `[`, `"`, -1)
-	modificationDate = strings.Replace(modificationDate, `]`, `"`, -1)
-	modificationDate = strings.Replace(modificationDate, ` `, `-`, -1)
-	modificationDate = "    \"lastmod\": " + modificationDate + ","
-	hugoFrontMatter = append(hugoFrontMatter, modificationDate)
+	// Read the metadata block or table, then the heading line by line, i is the number of lines they take up
+	metadata := parseMetadataBlock(markdownfile.Contents, configuration.MetadataKeys)
+	reportUnknownMetadata(metadata, configuration.MetadataKeys, docxFilePath)
+	i := metadata.Lines
+	frontMatter := FrontMatter{Aliases: article.Aliases}
+	frontMatter.Tags = splitList(metadata.Values["TAGS"])
+	frontMatter.Categories = splitList(metadata.Values["CATEGORIES"])
+	// Documents without dates take them from the source, created for the publication date and modified for the update
+	location := configuredLocation(configuration)
+	created := document.Created
+	if created.IsZero() {
+		created = document.Modified
+	}
+	frontMatter.Date, headerErr = frontMatterDate(metadata, "PUB_DATE", created, location)
+	if headerErr != nil {
+		return
+	}
+	frontMatter.PublishDate = frontMatter.Date
+	frontMatter.LastMod, headerErr = frontMatterDate(metadata, "UPDATE_DATE", document.Modified, location)
+	if headerErr != nil {
+		return
+	}
+	// Drafts and articles in review are written as hugo drafts, which stay off the site
+	status, headerErr := documentStatus(documentFolderStatus(document, configuration), metadata.Values["STATUS"])
+	if headerErr != nil {
+		return
+	}
+	frontMatter.Draft = status != statusPublished
+	if frontMatter.Draft {
+		frontMatter.Status = status
+	}
+	var value string
+	var found bool
 	// Now find the cover photo for the article
-	var imagenames []string
-	imagenames, i = regexLineOfMarkdown(markdownfile.Contents, `(\w+.png)`, `<img src=`, i)
-	if len(imagenames) >= 2 {
-		imagename := imagenames[1]
-		coverImagePathBefore := path.Dir(path.Dir(docxFilePath)) + "/" + imagename
-		coverImagePathBefore = strings.Replace(coverImagePathBefore, ` `, `\ `, -1)
-		//fmt.Println("image path before: " + coverImagePathBefore)
-		coverImagePathAfter := hugoDirectory + "static/images/" + imagename
-		coverImagePathAfter = strings.Replace(coverImagePathAfter, ` `, `\ `, -1)
-		//fmt.Println("image path after: " + coverImagePathAfter)
-		copyCoverImage := exec.Command("/bin/cp", coverImagePathBefore, coverImagePathAfter)
-		copyCoverImage.Dir = "/"
-		fmt.Println("Moving cover image image to hugo directory...")
-		out, err := copyCoverImage.CombinedOutput()
+	var source string
+	source, i, found = coverImageLine(markdownfile.Contents, i)
+	if found {
+		fmt.Println("Publishing the cover image " + source + "...")
+		cover, err := publishImage(source, mediaDirectory, images, configuration)
 		if err != nil {
-			fmt.Println("[ERROR] Error moving "+imagename+": ", err)
+			fmt.Println("[ERROR] Error publishing the cover image "+source+": ", err)
+		} else if cover.Name != "" {
+			frontMatter.Image = cover.Name
+			frontMatter.ImageWidth = cover.Width
+			frontMatter.ImageHeight = cover.Height
+			frontMatter.ImageSrcset = cover.srcset(images.URL)
 		}
-		fmt.Println("Moved the image: ", string(out))
-		frontmatterimage := "    \"image\": \"" + imagename + "\","
-		hugoFrontMatter = append(hugoFrontMatter, frontmatterimage)
 	}
 	// Caption for image
-	var frontimagecaption []string
-	frontimagecaption, i = regexLineOfMarkdown(markdownfile.Contents, `##### +(.*)`, `#####`, i)
-	frontimagecaption[0] = strings.Replace(frontimagecaption[0], `##### `, ``, -1)
-	frontmattercaption := "<p class=\"front-matter-image-caption\">" + frontimagecaption[0] + "</p>"
+	var frontimagecaption string
+	frontimagecaption, i, _ = metadataLine(markdownfile.Contents, "#####", i)
+	frontmattercaption := "<p class=\"front-matter-image-caption\">" + frontimagecaption + "</p>"
 	// Now find the headline of the article
-	var title []string
-	title, i = regexLineOfMarkdown(markdownfile.Contents, `# +(.*)`, `#`, i)
-	headline := fmt.Sprintf("%f", title)
-	headline = strings.Replace(headline, `%!f(string=# `, ``, -1)
-	headline = strings.Replace(headline, `)`, ``, -1)
-	headline = strings.Replace(headline, `(`, ``, -1)
-	headline = strings.Replace(headline, `[`, `"`, -1)
-	headline = strings.Replace(headline, `]`, `"`, -1)
-	headline = "    \"title\": " + headline + ","
-	hugoFrontMatter = append(hugoFrontMatter, headline)
+	value, i, _ = metadataLine(markdownfile.Contents, "# ", i)
+	frontMatter.Title = unescapeMarkdown(value)
 	// Find the subtitle
-	var subtitle []string
-	subtitle, i = regexLineOfMarkdown(markdownfile.Contents, `# +(.*)`, `##`, i)
-	description := fmt.Sprintf("%f", subtitle)
-	description = strings.Replace(description, `%!f(string=# `, ``, -1)
-	description = strings.Replace(description, `)`, ``, -1)
-	description = strings.Replace(description, `(`, ``, -1)
-	description = strings.Replace(description, `[`, `"`, -1)
-	description = strings.Replace(description, `]`, `"`, -1)
-	description = "    \"description\": " + description + ","
-	hugoFrontMatter = append(hugoFrontMatter, description)
+	value, i, _ = metadataLine(markdownfile.Contents, "## ", i)
+	frontMatter.Description = unescapeMarkdown(value)
 	// Find the authors on the byline
-	var authorNames []string
-	authorNames, i = regexLineOfMarkdown(markdownfile.Contents, `[^(####By |,and|,)](?:By | and)*?(\w+.\w+)`, `#### By`, i)
-	authorList := fmt.Sprintf("%f", authorNames)
-	authorList = strings.Replace(authorList, `%!f(string=`, `"`, -1)
-	authorList = strings.Replace(authorList, `) `, `", `, -1)
-	authorList = strings.Replace(authorList, `)`, `"`, -1)
-	authorList = "    \"authors\": " + authorList
-	hugoFrontMatter = append(hugoFrontMatter, authorList)
-	hugoFrontMatter = append(hugoFrontMatter, "}")
+	value, i, _ = metadataLine(markdownfile.Contents, "#### By", i)
+	frontMatter.Authors = splitByline(value)
+	// Static keys for the article's section, then the custom keys the document sets
+	frontMatter.Params, err = frontMatterParams(configuration.FrontMatterTemplate, article.Section)
+	if err != nil {
+		fmt.Println("[ERROR] Error reading the front matter template: ", err)
+	}
+	if frontMatter.Params == nil {
+		frontMatter.Params = make(map[string]interface{})
+	}
+	for key, value := range metadata.params(configuration.MetadataKeys) {
+		frontMatter.Params[key] = value
+	}
+	frontMatterText, headerErr := frontMatter.Marshal(configuration.FrontMatterFormat)
+	if headerErr != nil {
+		return
+	}
+	hugoFrontMatter := strings.Split(strings.TrimSuffix(string(frontMatterText), "\n"), "\n")
 	hugoFrontMatter = append(hugoFrontMatter, "")
 	hugoFrontMatter = append(hugoFrontMatter, frontmattercaption)
 	hugoFrontMatter = append(hugoFrontMatter, "")
@@ -736,126 +507,237 @@ func readMarkdownWriteHugoHeaders(markdownFilePath string, docxFilePath string,
 		if err != nil {
 			fmt.Println("[ERROR] Error reading lines from the markdown file: ", err)
 		}
-		if strings.Index(markdownfile.Contents[j], `<img src=`) >= 0 {
-			rewriteimageline.Add(1)
-			re2 := regexp.MustCompile(`(\w+.png)`)
-			inlineImage := re2.FindAllString(markdownfile.Contents[j], -1)
-			inlineImagePathBefore := path.Dir(path.Dir(docxFilePath)) + "/" + inlineImage[1]
-			inlineImagePathBefore = strings.Replace(inlineImagePathBefore, ` `, `\ `, -1)
-			inlineImagePathAfter := hugoDirectory + "static/images/" + inlineImage[1]
-			inlineImagePathAfter = strings.Replace(inlineImagePathAfter, ` `, `\ `, -1)
-			copyImage := exec.Command("/bin/cp", inlineImagePathBefore, inlineImagePathAfter)
-			copyImage.Dir = "/"
-			fmt.Println("Moving inline image to hugo directory...")
-			out, err := copyImage.Output()
+		if j >= len(markdownfile.Contents) {
+			break
+		}
+		if imageSource(markdownfile.Contents[j]) == "" {
+			continue
+		}
+		// Use the image caption under the image as the alt text for the inline-image
+		caption, captionEnd, found := metadataLine(markdownfile.Contents, "#####", j+1)
+		if found {
+			caption = unescapeMarkdown(caption)
+		}
+		// Rewrite the inline images to have a css class called inline-image
+		newimageline, captioned := rewriteInlineImages(markdownfile.Contents[j], caption, images.URL, func(source string) publishedImage {
+			inline, err := publishImage(source, mediaDirectory, images, configuration)
 			if err != nil {
-				fmt.Println("[ERROR] Error moving "+inlineImage[1]+": ", err)
-				return
+				fmt.Println("[ERROR] Error publishing the image "+source+": ", err)
+				return publishedImage{}
+			}
+			if inline.Name != "" {
+				fmt.Println("Published the image " + source + " as " + images.Directory + inline.Name)
 			}
-			fmt.Println("Moving the image: ", out)
-			fmt.Println("Done moving " + inlineImage[1])
-			// Before writing the new line make sure that the path points to the production directory
-			inlineImagePathAfter = productionDirectory + "public/images/" + inlineImage[1]
-			fmt.Println("Writing a new inline-image path for " + markdownFilePath)
-			// Use the image caption as the alt text for the inline-image
-			regexAltText := regexp.MustCompile(`##### +(.*)`)
-			altTexts := regexAltText.FindAllString(markdownfile.Contents[j+2], -1)
-			altText := strings.Replace(altTexts[0], `##### `, ``, -1)
-			// Rewrite the inline image to have a css class called inline-image
-			newimageinline := "<img src=\"" + inlineImagePathAfter + "\" alt=\"" + altText + "\" class=\"inline-image\">"
-			go rewriteMarkdownLine(j, newimageinline, markdownFilePath, &rewriteimageline)
+			return inline
+		})
+		if newimageline != markdownfile.Contents[j] {
+			fmt.Println("Writing new inline-image paths for " + markdownFilePath)
+			rewriteimageline.Add(1)
+			go rewriteMarkdownLine(j, newimageline, markdownFilePath, &rewriteimageline)
 			rewriteimageline.Wait()
-			j = j + 2
+		}
+		if captioned {
+			j = captionEnd - 1
 		}
 	}
 	fmt.Println("Done!")
-	front_matter.Done()
 }
 
-// Use hugo to compile the markdown files into html and then move the files to the production directory, i.e. where nginx or apache serve files
-// Make sure to chown or chmod the production directory before running driveraker
-func compileAndServeHugoSite(hugoDirectory string, productionDirectory string, copyHugoSiteToProductionPath string, serve *sync.WaitGroup) {
-	compile := exec.Command("/usr/bin/hugo")
-	compile.Dir = hugoDirectory
-	out, err := compile.Output()
-	if err != nil {
-		fmt.Println("[ERROR] Error compiling a website with hugo: ", err)
+// Take down the articles of deleted documents and turn pending documents into articles.
+// Articles are put together in a working directory and only moved into the hugo site once
+// finished, so an interrupted run never leaves a half written article behind.
+// Returns whether anything in the hugo site changed.
+func applyPendingChanges(manifest *Manifest, configuration Configuration) bool {
+	hugoPostDirectory := configuration.HugoPostDirectory
+	productionDirectory := configuration.ProductionDirectory
+	changed := false
+	for _, article := range manifest.PendingDeletions() {
+		err := unpublishArticle(article, hugoPostDirectory, productionDirectory, configuration.PreviewDirectory, configuration.DeletionPolicy, configuration.ArchiveDirectory)
+		if err != nil {
+			fmt.Println("[ERROR] Error unpublishing "+article.Document.Path+": ", err)
+			continue
+		}
+		delete(manifest.Documents, article.Document.ID)
+		changed = true
 	}
-	fmt.Println("hugo: ", string(out))
-	publishHugoSite := exec.Command("/bin/bash", copyHugoSiteToProductionPath, hugoDirectory+"public/", productionDirectory)
-	publishHugoSite.Dir = "/"
-	fmt.Println("Copying hugo compiled site to production directory...")
-	out, err = publishHugoSite.Output()
-	if err != nil {
-		fmt.Println("[ERROR] Error copying hugo site to production: ", err)
+	articles := manifest.PendingArticles()
+	if len(articles) == 0 {
+		return changed
 	}
-	fmt.Printf("copying hugo site to production: " + string(out))
-	serve.Done()
-}
-
-func main() {
-	// Get the user's home directory
-	usr, err := user.Current()
-	HOME := usr.HomeDir
+	workDirectory, err := ioutil.TempDir("", "driveraker")
 	if err != nil {
-		fmt.Println("[ERROR] driveraker could not get the user's home directory")
-	}
-	// Set the driveraker config path
-	driverakerConfigPath := HOME + "/.config/driveraker/config"
-	// Set the copy Hugo compiled site to production directory script path
-	copyHugoSiteScript := HOME + "/.config/driveraker/copyHugoSite.sh"
-	// Read the driveraker config
-	confMessage := make(chan string)
-	var conf sync.WaitGroup
-	conf.Add(1)
-	go readConfig(driverakerConfigPath, &conf, confMessage)
-	// Set the configured paths
-	driveSyncDirectory := <-confMessage
-	driveRemoteDirectory := <-confMessage
-	hugoPostDirectory := <-confMessage
-	productionDirectory := <-confMessage
-	hashtablePath := <-confMessage
-	conf.Wait()
-	// Sync Google Drive
-	docxPathsMessage := make(chan []string)
-	var driveSync sync.WaitGroup
-	driveSync.Add(1)
-	go syncGoogleDrive(driveSyncDirectory, driveRemoteDirectory, hashtablePath, &driveSync, docxPathsMessage)
-	docxFilePaths := <-docxPathsMessage
-	fmt.Printf("docx file paths: %s \n", docxFilePaths)
-	driveSync.Wait()
+		fmt.Println("[ERROR] Error making a working directory: ", err)
+		return changed
+	}
+	defer os.RemoveAll(workDirectory)
 	// Convert the docx files into markdown files
-	var pandoc sync.WaitGroup
-	pandoc.Add(len(docxFilePaths))
+	converter := newConverter(configuration)
+	var conversion sync.WaitGroup
+	conversion.Add(len(articles))
+	conversionMessages := make([]chan error, len(articles))
 	var markdownPaths []string
 	fmt.Println("Converting synced docx files into markdown files...")
-	for i := 0; i < len(docxFilePaths); i++ {
-		fmt.Println("Converting " + docxFilePaths[i])
-		nameRegex := regexp.MustCompile(`(\w+)(?:.docx)`)
-		name := nameRegex.FindAllString(docxFilePaths[i], -1)
-		markdownPath := hugoPostDirectory + "content/articles/" + name[0] + ".md"
+	for i, article := range articles {
+		fmt.Println("Converting " + article.Document.ExportPath)
+		markdownPath := filepath.Join(workDirectory, fmt.Sprintf("%d.md", i))
 		markdownPaths = append(markdownPaths, markdownPath)
-		go convertToMarkdownWithPandoc(docxFilePaths[i], markdownPath, &pandoc)
+		conversionMessages[i] = make(chan error, 1)
+		go convertToMarkdown(converter, article.Document.ExportPath, markdownPath, &conversion, conversionMessages[i])
 	}
-	pandoc.Wait()
+	conversion.Wait()
 	// Add hugo front-matter to the files
 	var frontmatter sync.WaitGroup
-	frontmatter.Add(len(markdownPaths))
+	frontMatterMessages := make([]chan error, len(articles))
 	fmt.Println("Adding hugo front-matter to markdown files...")
-	for i := 0; i < len(markdownPaths); i++ {
-		go readMarkdownWriteHugoHeaders(markdownPaths[i], docxFilePaths[i], hugoPostDirectory, productionDirectory, &frontmatter)
+	for i, article := range articles {
+		// A document that fails stays pending without holding up the others
+		err = <-conversionMessages[i]
+		if err != nil {
+			fmt.Println("[ERROR] Error converting "+article.Document.ExportPath+" with "+converter.Name()+", it stays pending: ", err)
+			manifest.Documents[article.Document.ID].LastError = err.Error()
+			continue
+		}
+		frontmatter.Add(1)
+		frontMatterMessages[i] = make(chan error, 1)
+		go readMarkdownWriteHugoHeaders(markdownPaths[i], article, configuration, &frontmatter, frontMatterMessages[i])
 	}
 	frontmatter.Wait()
-	// Serve the website by compiling the site with hugo and moving it to the production directory
-	var serveWebsite sync.WaitGroup
-	serveWebsite.Add(1)
-	go compileAndServeHugoSite(hugoPostDirectory, productionDirectory, copyHugoSiteScript, &serveWebsite)
-	serveWebsite.Wait()
-	// Send back a success message and code
-	fmt.Println("driveraker successfully synced, converted, and compiled Google Documents into a website")
-	fmt.Println("Thanks to other open source projects like:")
-	fmt.Println("* Emmanuel Odeke's drive command line client for Google Drive")
-	fmt.Println("* John MacFarlane's pandoc file converter")
-	fmt.Println("* And many more...")
-	os.Exit(0)
+	for i, article := range articles {
+		if frontMatterMessages[i] == nil {
+			continue
+		}
+		err = <-frontMatterMessages[i]
+		if err != nil {
+			fmt.Println("[ERROR] Error in the metadata of "+article.Document.Path+", it stays pending: ", err)
+			manifest.Documents[article.Document.ID].LastError = err.Error()
+			continue
+		}
+		err = publishMarkdown(markdownPaths[i], article.MarkdownPath)
+		if err != nil {
+			fmt.Println("[ERROR] Error writing "+article.MarkdownPath+": ", err)
+			manifest.Documents[article.Document.ID].LastError = err.Error()
+			continue
+		}
+		changed = true
+		entry := manifest.Documents[article.Document.ID]
+		entry.ContentSHA256 = article.ContentSHA256
+		previousImages := entry.Images
+		entry.Images = articleImages(article.MarkdownPath)
+		// Images are named after their contents, so the ones a new version replaced are left over
+		for _, image := range unusedImages(previousImages, hugoPostDirectory) {
+			err = os.Remove(hugoPostDirectory + "static/images/" + image)
+			if err != nil && !os.IsNotExist(err) {
+				fmt.Println("[ERROR] Error removing the replaced image "+image+": ", err)
+			}
+		}
+		entry.PublishDate = articlePublishDate(article.MarkdownPath)
+		wasUnpublished := entry.Unpublished()
+		entry.Status = articleStatus(article.MarkdownPath)
+		// hugo leaves a draft out of the build but not out of public/, take down the published article.
+		// The preview builds drafts, so it keeps the article.
+		if entry.Unpublished() && !wasUnpublished {
+			for _, renderedMarkdownPath := range []string{article.MarkdownPath, article.PreviousMarkdownPath} {
+				if renderedMarkdownPath == "" {
+					continue
+				}
+				err = removeRenderedArticle(renderedMarkdownPath, hugoPostDirectory, hugoPostDirectory+"public/", productionDirectory)
+				if err != nil {
+					fmt.Println("[ERROR] Error taking down "+renderedMarkdownPath+", now a "+entry.Status+": ", err)
+				}
+			}
+		}
+		if previewEnabled(configuration) {
+			entry.PreviewURL = previewURL(configuration, entry.Slug, entry.Section)
+		}
+		entry.Converted = time.Now()
+		entry.LastError = ""
+		// Renamed articles leave their old markdown file behind, hugo redirects the old URL through the aliases
+		if article.PreviousMarkdownPath != "" {
+			err = os.RemoveAll(articleLocation(article.PreviousMarkdownPath))
+			if err != nil && !os.IsNotExist(err) {
+				fmt.Println("[ERROR] Error removing the renamed article "+article.PreviousMarkdownPath+": ", err)
+			}
+		}
+		entry.PreviousMarkdownPath = ""
+	}
+	return changed
+}
+
+// Convert a single docx file into an article at markdownPath
+func convertDocument(docxFilePath string, markdownPath string, configuration Configuration) error {
+	workDirectory, err := ioutil.TempDir("", "driveraker")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workDirectory)
+	workPath := filepath.Join(workDirectory, "article.md")
+	converter := newConverter(configuration)
+	err = converter.Convert(docxFilePath, workPath)
+	if err != nil {
+		return fmt.Errorf("converting %s with %s: %v", docxFilePath, converter.Name(), err)
+	}
+	// The docx file's modification time stands in for the source's
+	document := Document{Path: docxFilePath, ExportPath: docxFilePath}
+	if info, err := os.Stat(docxFilePath); err == nil {
+		document.Modified = info.ModTime()
+	}
+	article := Article{Document: document, Section: configuration.Section, MarkdownPath: markdownPath}
+	var frontmatter sync.WaitGroup
+	frontmatter.Add(1)
+	frontMatterMessage := make(chan error, 1)
+	readMarkdownWriteHugoHeaders(workPath, article, configuration, &frontmatter, frontMatterMessage)
+	err = <-frontMatterMessage
+	if err != nil {
+		return err
+	}
+	return publishMarkdown(workPath, markdownPath)
+}
+
+// Move a finished article from the working directory into the hugo site
+func publishMarkdown(workPath string, markdownPath string) error {
+	contents, err := ioutil.ReadFile(workPath)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(markdownPath), 0755)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(markdownPath, contents, 0644)
+}
+
+// Use hugo to compile the markdown files into html
+func compileHugoSite(hugoDirectory string) error {
+	compile := exec.Command("/usr/bin/hugo")
+	compile.Dir = hugoDirectory
+	out, err := compile.Output()
+	fmt.Println("hugo: ", string(out))
+	if err != nil {
+		return fmt.Errorf("compiling a website with hugo: %v", err)
+	}
+	return nil
+}
+
+// Move the compiled files to the production directory, i.e. where nginx or apache serve files
+// Make sure to chown or chmod the production directory before running driveraker
+func publishHugoSite(hugoDirectory string, productionDirectory string, copyHugoSiteToProductionPath string) error {
+	publish := exec.Command("/bin/bash", copyHugoSiteToProductionPath, hugoDirectory+"public/", productionDirectory)
+	publish.Dir = "/"
+	fmt.Println("Copying hugo compiled site to production directory...")
+	out, err := publish.Output()
+	fmt.Print("copying hugo site to production: " + string(out))
+	if err != nil {
+		return fmt.Errorf("copying hugo site to production: %v", err)
+	}
+	return nil
+}
+
+// Use hugo to compile the markdown files into html and then move the files to the production directory
+func compileAndServeHugoSite(hugoDirectory string, productionDirectory string, copyHugoSiteToProductionPath string, serve *sync.WaitGroup, serveMessage chan error) {
+	err := compileHugoSite(hugoDirectory)
+	if err == nil {
+		err = publishHugoSite(hugoDirectory, productionDirectory, copyHugoSiteToProductionPath)
+	}
+	serveMessage <- err
+	serve.Done()
 }
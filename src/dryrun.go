@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Show what the next run would publish without writing to the hugo site, the production directory or the state.
+// The source still syncs without saving its state, so the API source exports into the sync directory as usual.
+// The drive CLI source does not pull, see driveCLIDryRun.
+func runDryRun(s *session) error {
+	configuration := s.configuration
+	source, err := newSource(configuration, true)
+	if err != nil {
+		return fmt.Errorf("setting up the source: %v", err)
+	}
+	if cli, ok := source.(*driveCLISource); ok {
+		fmt.Println("The drive CLI source does not pull in a dry run, so changes not yet in " + configuration.DriveSyncDirectory + " are left out")
+		source = &driveCLIDryRun{cli, s.manifest}
+	}
+	s.setPhase("dry run")
+	// The manifest is never saved, so the sync only changes it in memory
+	syncMessage := make(chan error, 1)
+	var driveSync sync.WaitGroup
+	driveSync.Add(1)
+	go syncGoogleDrive(source, s.manifest, configuration, &driveSync, syncMessage)
+	driveSync.Wait()
+	err = <-syncMessage
+	if err != nil {
+		return fmt.Errorf("syncing: %v", err)
+	}
+	scratchDirectory, err := ioutil.TempDir("", "driveraker-dry-run")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratchDirectory)
+	fmt.Println()
+	fmt.Println("Dry run, nothing was published:")
+	deletions := s.manifest.PendingDeletions()
+	for _, article := range deletions {
+		fmt.Println("* Unpublish " + article.Document.Path + ": " + deletionAction(article, configuration))
+	}
+	articles := s.manifest.PendingArticles()
+	for i, article := range articles {
+		action := "New article"
+		if article.PreviousMarkdownPath != "" {
+			action = "Moved article, from " + article.PreviousMarkdownPath + ","
+		} else if published, _ := exists(article.MarkdownPath); published {
+			action = "Updated article"
+		}
+		fmt.Println("* " + action + " " + article.MarkdownPath + " from " + article.Document.Path)
+		frontMatter, images, err := previewArticle(article, filepath.Join(scratchDirectory, fmt.Sprintf("%d", i)), configuration)
+		if err != nil {
+			fmt.Println("    [ERROR] Could not read the front matter: ", err)
+			continue
+		}
+		for _, line := range frontMatter {
+			fmt.Println("    " + line)
+		}
+		for _, image := range images {
+			fmt.Println("    Copies image " + image + " to " + articleImageDestination(article.MarkdownPath, configuration.HugoPostDirectory).Directory)
+		}
+	}
+	if len(deletions) == 0 && len(articles) == 0 {
+		fmt.Println("* No articles to publish or unpublish")
+	}
+	if len(deletions) > 0 || len(articles) > 0 || len(s.manifest.unbuilt()) > 0 {
+		fmt.Println("* hugo would rebuild the site and copy it to " + configuration.ProductionDirectory)
+		if previewEnabled(configuration) {
+			fmt.Println("* hugo would rebuild the preview and copy it to " + configuration.PreviewDirectory)
+		}
+	} else {
+		fmt.Println("* hugo would not rebuild the site")
+	}
+	return nil
+}
+
+// A drive pull cannot look at the changes without taking them, and the next run would then see none.
+// Instead a dry run compares the mirror as the last pull left it with the manifest.
+type driveCLIDryRun struct {
+	*driveCLISource
+	manifest *Manifest
+}
+
+// Exports missing from the manifest are added and ones whose hash differs modified,
+// documents of the manifest no longer in the mirror are deleted
+func (source *driveCLIDryRun) Changes(cursor string) ([]Change, string, error) {
+	documents, err := source.ListDocuments()
+	if err != nil {
+		return nil, cursor, err
+	}
+	var changes []Change
+	listed := make(map[string]bool)
+	for _, document := range documents {
+		listed[document.ID] = true
+		entry := source.manifest.Documents[document.ID]
+		if entry == nil || entry.Deleted {
+			changes = append(changes, Change{ChangeAdded, document})
+			continue
+		}
+		hash, err := hashFile(document.ExportPath)
+		if err != nil {
+			return nil, cursor, err
+		}
+		if hash != entry.ExportSHA256 {
+			changes = append(changes, Change{ChangeModified, document})
+		}
+	}
+	for _, id := range source.manifest.sortedIDs() {
+		if entry := source.manifest.Documents[id]; !listed[id] && !entry.Deleted {
+			changes = append(changes, Change{ChangeDeleted, Document{ID: id, Path: entry.SourcePath, ExportPath: entry.ExportPath}})
+		}
+	}
+	return changes, cursor, nil
+}
+
+// Run the converter and the front matter extraction on an article in a scratch directory,
+// returning the front matter and the images it would copy.
+// Front matter extraction copies images into the hugo site, so it gets a scratch site of its own.
+func previewArticle(article Article, scratchDirectory string, configuration Configuration) ([]string, []string, error) {
+	scratchHugoDirectory := scratchDirectory + "/hugo/"
+	scratchArticle := article
+	scratchArticle.MarkdownPath = scratchHugoDirectory + strings.TrimPrefix(article.MarkdownPath, configuration.HugoPostDirectory)
+	imageDirectory := articleImageDestination(scratchArticle.MarkdownPath, scratchHugoDirectory).Directory
+	err := os.MkdirAll(imageDirectory, 0755)
+	if err != nil {
+		return nil, nil, err
+	}
+	markdownPath := scratchDirectory + "/article.md"
+	converter := newConverter(configuration)
+	err = converter.Convert(article.Document.ExportPath, markdownPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("converting %s with %s: %v", article.Document.ExportPath, converter.Name(), err)
+	}
+	var frontmatter sync.WaitGroup
+	frontmatter.Add(1)
+	scratchConfiguration := configuration
+	scratchConfiguration.HugoPostDirectory = scratchHugoDirectory
+	frontMatterMessage := make(chan error, 1)
+	readMarkdownWriteHugoHeaders(markdownPath, scratchArticle, scratchConfiguration, &frontmatter, frontMatterMessage)
+	err = <-frontMatterMessage
+	if err != nil {
+		return nil, nil, err
+	}
+	contents, err := ioutil.ReadFile(markdownPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	frontMatter, _ := splitFrontMatter(strings.Split(string(contents), "\n"))
+	copied, _ := ioutil.ReadDir(imageDirectory)
+	var images []string
+	for _, image := range copied {
+		images = append(images, image.Name())
+	}
+	return frontMatter, images, nil
+}
+
+// What the deletion policy would do to an article
+func deletionAction(article Article, configuration Configuration) string {
+	switch configuration.DeletionPolicy {
+	case "", "archive":
+		archiveDirectory := configuration.ArchiveDirectory
+		if archiveDirectory == "" {
+			archiveDirectory = configuration.HugoPostDirectory + "archive/"
+		}
+		return "archive " + article.MarkdownPath + " to " + archiveDirectory + path.Dir(contentPath(article.MarkdownPath, configuration.HugoPostDirectory)) + "/"
+	case "delete":
+		return "delete " + article.MarkdownPath
+	case "draft":
+		return "mark " + article.MarkdownPath + " as a draft"
+	}
+	return fmt.Sprintf("unknown deletion policy %q", configuration.DeletionPolicy)
+}
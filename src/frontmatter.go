@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The hugo front matter driveraker writes for an article
+type FrontMatter struct {
+	Title       string
+	Description string
+	Authors     []string
+	Tags        []string
+	Categories  []string
+	Draft       bool
+	// The workflow status of drafts and articles in review
+	Status      string
+	Date        string
+	PublishDate string
+	LastMod     string
+	Image       string
+	// The size of the cover image and its responsive variants, for the theme's <img> tag
+	ImageWidth  int
+	ImageHeight int
+	ImageSrcset string
+	// Old URLs of a renamed article
+	Aliases []string
+	// Static keys from the front matter template, the keys above take precedence
+	Params map[string]interface{}
+}
+
+// A key and value of the front matter in the order they are written
+type frontMatterField struct {
+	Key   string
+	Value interface{}
+}
+
+// The front matter fields in a stable order, leaving out the empty optional ones
+func (frontMatter FrontMatter) fields() []frontMatterField {
+	fields := []frontMatterField{
+		{"title", frontMatter.Title},
+		{"description", frontMatter.Description},
+		{"authors", nonNil(frontMatter.Authors)},
+		{"tags", nonNil(frontMatter.Tags)},
+		{"categories", nonNil(frontMatter.Categories)},
+		{"draft", frontMatter.Draft},
+	}
+	for _, field := range []frontMatterField{
+		{"status", frontMatter.Status},
+		{"date", frontMatter.Date},
+		{"publishDate", frontMatter.PublishDate},
+		{"lastmod", frontMatter.LastMod},
+		{"image", frontMatter.Image},
+		{"imageSrcset", frontMatter.ImageSrcset},
+	} {
+		if field.Value != "" {
+			fields = append(fields, field)
+		}
+	}
+	if frontMatter.ImageWidth > 0 {
+		fields = append(fields, frontMatterField{"imageWidth", frontMatter.ImageWidth}, frontMatterField{"imageHeight", frontMatter.ImageHeight})
+	}
+	if len(frontMatter.Aliases) > 0 {
+		fields = append(fields, frontMatterField{"aliases", frontMatter.Aliases})
+	}
+	taken := make(map[string]bool)
+	for _, field := range fields {
+		taken[strings.ToLower(field.Key)] = true
+	}
+	var extraKeys []string
+	for key := range frontMatter.Params {
+		if !taken[strings.ToLower(key)] {
+			extraKeys = append(extraKeys, key)
+		}
+	}
+	sort.Strings(extraKeys)
+	for _, key := range extraKeys {
+		fields = append(fields, frontMatterField{key, frontMatter.Params[key]})
+	}
+	return fields
+}
+
+// Empty lists are written as [] rather than null
+func nonNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+// Serialize the front matter in hugo's JSON, TOML (+++) or YAML (---) format
+func (frontMatter FrontMatter) Marshal(format string) ([]byte, error) {
+	var buffer bytes.Buffer
+	fields := frontMatter.fields()
+	switch format {
+	case "", "json":
+		buffer.WriteString("{\n")
+		for i, field := range fields {
+			value, err := frontMatterValue(field.Value)
+			if err != nil {
+				return nil, err
+			}
+			key, _ := frontMatterValue(field.Key)
+			separator := ","
+			if i == len(fields)-1 {
+				separator = ""
+			}
+			fmt.Fprintf(&buffer, "    %s: %s%s\n", key, value, separator)
+		}
+		buffer.WriteString("}\n")
+	case "yaml":
+		buffer.WriteString("---\n")
+		for _, field := range fields {
+			err := writeYAMLField(&buffer, "", field.Key, field.Value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		buffer.WriteString("---\n")
+	case "toml":
+		buffer.WriteString("+++\n")
+		for _, field := range fields {
+			// TOML has no null, a key without a value is left out
+			if field.Value == nil {
+				continue
+			}
+			value, err := tomlValue(field.Value)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&buffer, "%s = %s\n", tomlKey(field.Key), value)
+		}
+		buffer.WriteString("+++\n")
+	default:
+		return nil, fmt.Errorf("unknown front matter format %q", format)
+	}
+	return buffer.Bytes(), nil
+}
+
+// Encode a value as JSON without escaping HTML characters, hugo reads them as is
+func frontMatterValue(value interface{}) (string, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	err := encoder.Encode(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buffer.String(), "\n"), nil
+}
+
+var bareTOMLKeyRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// A TOML key, quoted unless it is a bare key. JSON string escapes are also valid in TOML basic strings.
+func tomlKey(key string) string {
+	if bareTOMLKeyRegex.MatchString(key) {
+		return key
+	}
+	quoted, _ := frontMatterValue(key)
+	return quoted
+}
+
+// A TOML value, with tables written inline and their keys sorted
+func tomlValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		var pairs []string
+		for _, key := range sortedKeys(value) {
+			if value[key] == nil {
+				continue
+			}
+			item, err := tomlValue(value[key])
+			if err != nil {
+				return "", err
+			}
+			pairs = append(pairs, tomlKey(key)+" = "+item)
+		}
+		if len(pairs) == 0 {
+			return "{}", nil
+		}
+		return "{ " + strings.Join(pairs, ", ") + " }", nil
+	case []interface{}:
+		var items []string
+		for _, item := range value {
+			if item == nil {
+				continue
+			}
+			encoded, err := tomlValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, encoded)
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	}
+	// Strings, numbers, booleans and lists of strings are written the same as in JSON
+	return frontMatterValue(value)
+}
+
+var plainYAMLKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// Plain YAML scalars that a reader would not take for a string
+var yamlKeywords = map[string]bool{"true": true, "false": true, "yes": true, "no": true, "on": true, "off": true, "null": true, "y": true, "n": true}
+
+// A YAML key, double quoted unless it is a plain word. JSON strings are also YAML double quoted strings.
+func yamlKey(key string) string {
+	if plainYAMLKeyRegex.MatchString(key) && !yamlKeywords[strings.ToLower(key)] {
+		return key
+	}
+	quoted, _ := frontMatterValue(key)
+	return quoted
+}
+
+// Write a YAML key and value, tables as block mappings indented under their key
+// and everything else as JSON, which YAML reads as flow scalars and sequences
+func writeYAMLField(buffer *bytes.Buffer, indent string, key string, value interface{}) error {
+	if table, ok := value.(map[string]interface{}); ok && len(table) > 0 {
+		fmt.Fprintf(buffer, "%s%s:\n", indent, yamlKey(key))
+		for _, tableKey := range sortedKeys(table) {
+			err := writeYAMLField(buffer, indent+"  ", tableKey, table[tableKey])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	encoded, err := frontMatterValue(value)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(buffer, "%s%s: %s\n", indent, yamlKey(key), encoded)
+	return nil
+}
+
+func sortedKeys(table map[string]interface{}) []string {
+	var keys []string
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Read the front matter template, a JSON, TOML or YAML file mapping sections to the static
+// keys their articles get. Keys under "*" go in every article, a section's own keys win over them.
+func frontMatterParams(templatePath string, section string) (map[string]interface{}, error) {
+	if templatePath == "" {
+		return nil, nil
+	}
+	contents, err := ioutil.ReadFile(templatePath)
+	if err != nil {
+		return nil, err
+	}
+	contents, err = configJSON(templatePath, contents)
+	if err != nil {
+		return nil, err
+	}
+	var template map[string]map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.UseNumber()
+	err = decoder.Decode(&template)
+	if err != nil {
+		return nil, fmt.Errorf("reading the front matter template %s: %v", templatePath, jsonErrorPosition(contents, err))
+	}
+	params := make(map[string]interface{})
+	for _, keys := range []map[string]interface{}{template["*"], template[section]} {
+		for key, value := range keys {
+			params[key] = value
+		}
+	}
+	return params, nil
+}
+
+// Split the lines of an article into its front matter, delimiters included, and the rest
+func splitFrontMatter(lines []string) (frontMatter []string, body []string) {
+	if len(lines) == 0 {
+		return nil, lines
+	}
+	closing := map[string]string{"{": "}", "---": "---", "+++": "+++"}[lines[0]]
+	if closing == "" {
+		return nil, lines
+	}
+	for i := 1; i < len(lines); i++ {
+		if lines[i] == closing {
+			return lines[:i+1], lines[i+1:]
+		}
+	}
+	return nil, lines
+}
+
+// The draft key in any front matter format, including the quoted "false" of older articles
+var draftRegex = regexp.MustCompile(`(?m)^(\s*"?draft"?\s*[:=]\s*)"?false"?(,?)\s*$`)
+
+// Mark an article a draft whatever its front matter format
+func markDraft(contents string) string {
+	matched := false
+	return draftRegex.ReplaceAllStringFunc(contents, func(line string) string {
+		if matched {
+			return line
+		}
+		matched = true
+		return draftRegex.ReplaceAllString(line, "${1}true${2}")
+	})
+}
+
+// A string key of the article's front matter in any format, empty when it has none
+func frontMatterString(markdownPath string, key string) string {
+	contents, err := ioutil.ReadFile(markdownPath)
+	if err != nil {
+		return ""
+	}
+	frontMatter, _ := splitFrontMatter(strings.Split(string(contents), "\n"))
+	keyRegex := regexp.MustCompile(`(?m)^\s*"?` + regexp.QuoteMeta(key) + `"?\s*[:=]\s*"([^"]*)"`)
+	match := keyRegex.FindStringSubmatch(strings.Join(frontMatter, "\n"))
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// When the article at markdownPath is published, zero when it has no publish date
+func articlePublishDate(markdownPath string) time.Time {
+	publishDate, _ := time.Parse(time.RFC3339, frontMatterString(markdownPath, "publishDate"))
+	return publishDate
+}
+
+// The workflow status of the article at markdownPath, only drafts and articles in review record one
+func articleStatus(markdownPath string) string {
+	if status := frontMatterString(markdownPath, "status"); status != "" {
+		return status
+	}
+	return statusPublished
+}
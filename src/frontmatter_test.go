@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// A front matter with template keys that need quoting and nested values
+func awkwardFrontMatter() FrontMatter {
+	return FrontMatter{
+		Title:   `Ben & Jerry's "best" scoop`,
+		Tags:    []string{"ice cream", "a,b"},
+		Draft:   true,
+		Status:  "review",
+		Aliases: []string{"/articles/old/"},
+		Params: map[string]interface{}{
+			"menu main": "x",
+			"params": map[string]interface{}{
+				"show toc": true,
+				"nested":   map[string]interface{}{"depth": json.Number("2"), "a.b": "c"},
+				"empty":    map[string]interface{}{},
+			},
+			"related": []interface{}{map[string]interface{}{"name": "one"}, "two", nil},
+			"yes":     "no",
+			"nothing": nil,
+			"weight":  json.Number("3"),
+		},
+	}
+}
+
+func TestFrontMatterMarshalTOML(t *testing.T) {
+	marshalled, err := awkwardFrontMatter().Marshal("toml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `+++
+title = "Ben & Jerry's \"best\" scoop"
+description = ""
+authors = []
+tags = ["ice cream","a,b"]
+categories = []
+draft = true
+status = "review"
+aliases = ["/articles/old/"]
+"menu main" = "x"
+params = { empty = {}, nested = { "a.b" = "c", depth = 2 }, "show toc" = true }
+related = [{ name = "one" }, "two"]
+weight = 3
+yes = "no"
++++
+`
+	if string(marshalled) != want {
+		t.Errorf("got\n%s\nwant\n%s", marshalled, want)
+	}
+}
+
+func TestFrontMatterMarshalYAML(t *testing.T) {
+	marshalled, err := awkwardFrontMatter().Marshal("yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `---
+title: "Ben & Jerry's \"best\" scoop"
+description: ""
+authors: []
+tags: ["ice cream","a,b"]
+categories: []
+draft: true
+status: "review"
+aliases: ["/articles/old/"]
+"menu main": "x"
+nothing: null
+params:
+  empty: {}
+  nested:
+    "a.b": "c"
+    depth: 2
+  "show toc": true
+related: [{"name":"one"},"two",null]
+weight: 3
+"yes": "no"
+---
+`
+	if string(marshalled) != want {
+		t.Errorf("got\n%s\nwant\n%s", marshalled, want)
+	}
+}
+
+func TestFrontMatterMarshalJSON(t *testing.T) {
+	frontMatter := awkwardFrontMatter()
+	marshalled, err := frontMatter.Marshal("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	err = json.Unmarshal(marshalled, &decoded)
+	if err != nil {
+		t.Fatalf("%v in\n%s", err, marshalled)
+	}
+	want := map[string]interface{}{"show toc": true, "nested": map[string]interface{}{"depth": 2.0, "a.b": "c"}, "empty": map[string]interface{}{}}
+	if decoded["title"] != frontMatter.Title || decoded["menu main"] != "x" || !reflect.DeepEqual(decoded["params"], want) {
+		t.Errorf("decoded %v", decoded)
+	}
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Widths of the responsive variants of an image when ImageWidths is not set
+var defaultImageWidths = []int{480, 960, 1600}
+
+const defaultImageQuality = 85
+
+// Larger images are refused rather than decoded, a 100 megapixel image takes 400 MB as RGBA
+const maxImagePixels = 100 * 1000 * 1000
+
+// Decoding and resizing takes a lot of memory for a photo, so the articles converted
+// side by side take turns at it
+var imageProcessing sync.Mutex
+
+// A width of an image as published
+type imageVariant struct {
+	Name   string
+	Width  int
+	Height int
+}
+
+// How an article shows an image: the widest variant, and the narrower ones for srcset.
+// Images driveraker cannot decode are published as they are and have no size.
+type publishedImage struct {
+	Name     string
+	Width    int
+	Height   int
+	Variants []imageVariant
+}
+
+// The srcset of the image with its URL prefix, empty for an image without variants
+func (published publishedImage) srcset(url string) string {
+	if len(published.Variants) < 2 {
+		return ""
+	}
+	var candidates []string
+	for _, variant := range published.Variants {
+		candidates = append(candidates, url+variant.Name+" "+strconv.Itoa(variant.Width)+"w")
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// The attributes of an <img> tag beyond its src and alt
+func (published publishedImage) attributes(url string) string {
+	var attributes string
+	if srcset := published.srcset(url); srcset != "" {
+		attributes += fmt.Sprintf(` srcset="%s" sizes="(max-width: %dpx) 100vw, %dpx"`, srcset, published.Width, published.Width)
+	}
+	if published.Width > 0 {
+		attributes += fmt.Sprintf(` width="%d" height="%d"`, published.Width, published.Height)
+	}
+	return attributes
+}
+
+// Resize and recompress a PNG, JPEG or still GIF into a variant per width below the image's own,
+// plus one at its own width or the widest of widths, whichever is narrower. Re-encoding leaves out
+// the EXIF data phones write, their GPS position included, after turning the image the way it says.
+// Variants are named after key, see imageVariantKey, and their width, so an image that was
+// processed before with the same settings is found by its name and not processed again.
+// Animated GIFs and formats Go cannot decode give ok false and are published as they are.
+func processImage(data []byte, key string, directory string, widths []int, quality int) (published publishedImage, ok bool, err error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return publishedImage{}, false, nil
+	}
+	if format == "gif" {
+		animation, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil || len(animation.Image) > 1 {
+			return publishedImage{}, false, nil
+		}
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return publishedImage{}, false, nil
+	}
+	if config.Width*config.Height > maxImagePixels {
+		return publishedImage{}, false, fmt.Errorf("the image is %dx%d, larger than driveraker processes", config.Width, config.Height)
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = jpegOrientation(data)
+	}
+	width, height := config.Width, config.Height
+	// Orientations 5 to 8 turn the image on its side
+	if orientation >= 5 {
+		width, height = height, width
+	}
+	// Still GIFs are written as PNG, GIF's 256 colors would band a resized photo
+	extension := ".png"
+	if format == "jpeg" {
+		extension = ".jpg"
+	}
+	for _, variantWidth := range imageVariantWidths(width, widths) {
+		variantHeight := (height*variantWidth + width/2) / width
+		if variantHeight < 1 {
+			variantHeight = 1
+		}
+		published.Variants = append(published.Variants, imageVariant{
+			Name:   key + "-" + strconv.Itoa(variantWidth) + "w" + extension,
+			Width:  variantWidth,
+			Height: variantHeight,
+		})
+	}
+	widest := published.Variants[len(published.Variants)-1]
+	published.Name, published.Width, published.Height = widest.Name, widest.Width, widest.Height
+	var missing []imageVariant
+	for _, variant := range published.Variants {
+		if processed, _ := exists(directory + variant.Name); !processed {
+			missing = append(missing, variant)
+		}
+	}
+	if len(missing) == 0 {
+		return published, true, nil
+	}
+	imageProcessing.Lock()
+	defer imageProcessing.Unlock()
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return publishedImage{}, false, err
+	}
+	source := orientImage(toRGBA(decoded), orientation)
+	for _, variant := range missing {
+		resized := source
+		if variant.Width != width {
+			resized = resizeImage(source, variant.Width, variant.Height)
+		}
+		var encoded bytes.Buffer
+		if format == "jpeg" {
+			err = jpeg.Encode(&encoded, resized, &jpeg.Options{Quality: quality})
+		} else {
+			encoder := png.Encoder{CompressionLevel: png.BestCompression}
+			err = encoder.Encode(&encoded, resized)
+		}
+		if err != nil {
+			return publishedImage{}, false, err
+		}
+		err = writeFileAtomic(directory+variant.Name, encoded.Bytes(), 0644)
+		if err != nil {
+			return publishedImage{}, false, err
+		}
+	}
+	return published, true, nil
+}
+
+// The widths to publish an image of width at, narrowest first. Images are never enlarged.
+func imageVariantWidths(width int, widths []int) []int {
+	widest := width
+	if len(widths) > 0 {
+		sorted := append([]int(nil), widths...)
+		sort.Ints(sorted)
+		if max := sorted[len(sorted)-1]; max < widest {
+			widest = max
+		}
+		var variants []int
+		for _, variantWidth := range sorted {
+			if variantWidth < widest && (len(variants) == 0 || variants[len(variants)-1] != variantWidth) {
+				variants = append(variants, variantWidth)
+			}
+		}
+		return append(variants, widest)
+	}
+	return []int{widest}
+}
+
+func toRGBA(decoded image.Image) *image.RGBA {
+	bounds := decoded.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), decoded, bounds.Min, draw.Src)
+	return rgba
+}
+
+// Scale an image down by averaging the pixels each pixel of the result covers, first across then down.
+// Unlike picking the nearest pixel this keeps fine detail from turning into noise.
+func resizeImage(source *image.RGBA, width int, height int) *image.RGBA {
+	sourceWidth, sourceHeight := source.Bounds().Dx(), source.Bounds().Dy()
+	across := areaWeights(sourceWidth, width)
+	down := areaWeights(sourceHeight, height)
+	// The image scaled across, four channels a pixel
+	scaled := make([]float32, width*sourceHeight*4)
+	for y := 0; y < sourceHeight; y++ {
+		row := source.Pix[y*source.Stride:]
+		for x, weights := range across {
+			var sum [4]float32
+			for _, weight := range weights {
+				pixel := row[weight.Index*4:]
+				for c := 0; c < 4; c++ {
+					sum[c] += float32(pixel[c]) * weight.Amount
+				}
+			}
+			copy(scaled[(y*width+x)*4:], sum[:])
+		}
+	}
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y, weights := range down {
+		for x := 0; x < width; x++ {
+			var sum [4]float32
+			for _, weight := range weights {
+				pixel := scaled[(weight.Index*width+x)*4:]
+				for c := 0; c < 4; c++ {
+					sum[c] += pixel[c] * weight.Amount
+				}
+			}
+			for c := 0; c < 4; c++ {
+				resized.Pix[y*resized.Stride+x*4+c] = clampChannel(sum[c])
+			}
+		}
+	}
+	return resized
+}
+
+// How much of each source pixel goes into a pixel of the result
+type areaWeight struct {
+	Index  int
+	Amount float32
+}
+
+func areaWeights(sourceSize int, size int) [][]areaWeight {
+	scale := float64(sourceSize) / float64(size)
+	weights := make([][]areaWeight, size)
+	for i := range weights {
+		start, end := float64(i)*scale, float64(i+1)*scale
+		for j := int(start); j < sourceSize && float64(j) < end; j++ {
+			covered := minFloat(end, float64(j+1)) - maxFloat(start, float64(j))
+			if covered > 0 {
+				weights[i] = append(weights[i], areaWeight{j, float32(covered / scale)})
+			}
+		}
+	}
+	return weights
+}
+
+func minFloat(a float64, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a float64, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func clampChannel(value float32) uint8 {
+	switch {
+	case value <= 0:
+		return 0
+	case value >= 255:
+		return 255
+	}
+	return uint8(value + 0.5)
+}
+
+// Turn an image the way its EXIF orientation says it is meant to be seen
+func orientImage(source *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return source
+	}
+	width, height := source.Bounds().Dx(), source.Bounds().Dy()
+	oriented := image.NewRGBA(image.Rect(0, 0, width, height))
+	if orientation >= 5 {
+		oriented = image.NewRGBA(image.Rect(0, 0, height, width))
+	}
+	bounds := oriented.Bounds()
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			var sourceX, sourceY int
+			switch orientation {
+			case 2:
+				sourceX, sourceY = width-1-x, y
+			case 3:
+				sourceX, sourceY = width-1-x, height-1-y
+			case 4:
+				sourceX, sourceY = x, height-1-y
+			case 5:
+				sourceX, sourceY = y, x
+			case 6:
+				sourceX, sourceY = y, height-1-x
+			case 7:
+				sourceX, sourceY = width-1-y, height-1-x
+			case 8:
+				sourceX, sourceY = width-1-y, x
+			}
+			copy(oriented.Pix[y*oriented.Stride+x*4:y*oriented.Stride+x*4+4], source.Pix[sourceY*source.Stride+sourceX*4:])
+		}
+	}
+	return oriented
+}
+
+// The EXIF orientation of a JPEG, 1 for upright when it has none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		// The image data starts at SOS, the metadata segments come before it
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// Read the orientation tag from the first IFD of EXIF data
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 1
+		}
+	}
+	return 1
+}
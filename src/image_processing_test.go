@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// An image red on its left half and blue on its right half
+func testImage(width int, height int) *image.RGBA {
+	rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < width/2 {
+				rgba.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				rgba.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	return rgba
+}
+
+// A JPEG of testImage with an EXIF segment giving its orientation, none when it is 0
+func testJPEG(t *testing.T, width int, height int, orientation int) []byte {
+	var encoded bytes.Buffer
+	err := jpeg.Encode(&encoded, testImage(width, height), &jpeg.Options{Quality: 95})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := encoded.Bytes()
+	if orientation == 0 {
+		return data
+	}
+	// A big endian TIFF header and an IFD with only the orientation tag
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	binary.BigEndian.PutUint16(tiff[18:], uint16(orientation))
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+	return append(append(append([]byte(nil), data[:2]...), app1...), data[2:]...)
+}
+
+// Decode a variant processImage wrote
+func readVariant(t *testing.T, directory string, variant imageVariant) (image.Image, []byte) {
+	data, err := ioutil.ReadFile(directory + variant.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("%s: %v", variant.Name, err)
+	}
+	return decoded, data
+}
+
+func TestImageVariantWidths(t *testing.T) {
+	for _, test := range []struct {
+		width  int
+		widths []int
+		want   []int
+	}{
+		{2000, []int{480, 960, 1600}, []int{480, 960, 1600}},
+		{1000, []int{480, 960, 1600}, []int{480, 960, 1000}},
+		{960, []int{1600, 960, 480, 480}, []int{480, 960}},
+		{300, []int{480, 960, 1600}, []int{300}},
+		{1000, nil, []int{1000}},
+		{1000, []int{}, []int{1000}},
+	} {
+		if got := imageVariantWidths(test.width, test.widths); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%d wide at %v gave %v, want %v", test.width, test.widths, got, test.want)
+		}
+	}
+}
+
+func TestProcessImageVariants(t *testing.T) {
+	var encoded bytes.Buffer
+	err := png.Encode(&encoded, testImage(1000, 500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory := t.TempDir() + "/"
+	published, ok, err := processImage(encoded.Bytes(), "key", directory, []int{480, 960, 1600}, 85)
+	if err != nil || !ok {
+		t.Fatalf("processing gave %v, %v", ok, err)
+	}
+	want := []imageVariant{{"key-480w.png", 480, 240}, {"key-960w.png", 960, 480}, {"key-1000w.png", 1000, 500}}
+	if !reflect.DeepEqual(published.Variants, want) {
+		t.Errorf("variants %+v, want %+v", published.Variants, want)
+	}
+	if published.Name != "key-1000w.png" || published.Width != 1000 || published.Height != 500 {
+		t.Errorf("published as %s at %dx%d, want the source's own width", published.Name, published.Width, published.Height)
+	}
+	for _, variant := range published.Variants {
+		decoded, _ := readVariant(t, directory, variant)
+		if size := decoded.Bounds().Size(); size.X != variant.Width || size.Y != variant.Height || size.X > 1000 {
+			t.Errorf("%s is %v, want %dx%d and no wider than the source", variant.Name, size, variant.Width, variant.Height)
+		}
+	}
+}
+
+func TestProcessImageOrientation(t *testing.T) {
+	for _, test := range []struct {
+		orientation int
+		// Where the left half of the source ends up
+		redOnTop bool
+	}{
+		{6, true},
+		{8, false},
+	} {
+		data := testJPEG(t, 80, 40, test.orientation)
+		if orientation := jpegOrientation(data); orientation != test.orientation {
+			t.Fatalf("the test JPEG has orientation %d, want %d", orientation, test.orientation)
+		}
+		directory := t.TempDir() + "/"
+		published, ok, err := processImage(data, "key", directory, []int{20, 1600}, 85)
+		if err != nil || !ok {
+			t.Fatalf("orientation %d: processing gave %v, %v", test.orientation, ok, err)
+		}
+		want := []imageVariant{{"key-20w.jpg", 20, 40}, {"key-40w.jpg", 40, 80}}
+		if !reflect.DeepEqual(published.Variants, want) {
+			t.Errorf("orientation %d: variants %+v, want %+v", test.orientation, published.Variants, want)
+		}
+		for _, variant := range published.Variants {
+			decoded, variantData := readVariant(t, directory, variant)
+			if size := decoded.Bounds().Size(); size.X != variant.Width || size.Y != variant.Height {
+				t.Errorf("orientation %d: %s is %v, want %dx%d", test.orientation, variant.Name, size, variant.Width, variant.Height)
+			}
+			red, _, blue, _ := decoded.At(variant.Width/2, variant.Height/8).RGBA()
+			if (red > blue) != test.redOnTop {
+				t.Errorf("orientation %d: %s is turned the wrong way, red %d and blue %d at the top", test.orientation, variant.Name, red>>8, blue>>8)
+			}
+			// The EXIF data is left out, orientation and all
+			if bytes.Contains(variantData, []byte("Exif\x00\x00")) || jpegOrientation(variantData) != 1 {
+				t.Errorf("orientation %d: %s kept its EXIF data", test.orientation, variant.Name)
+			}
+		}
+	}
+}
+
+func TestPublishImageReusesVariants(t *testing.T) {
+	mediaDirectory := t.TempDir()
+	source := filepath.Join(mediaDirectory, "media", "image1.jpeg")
+	err := os.MkdirAll(filepath.Dir(source), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(source, testJPEG(t, 100, 50, 0), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination := imageDestination{Directory: t.TempDir() + "/"}
+	configuration := Configuration{ImageWidths: []int{50, 1600}, ImageQuality: 85}
+	first, err := publishImage(source, mediaDirectory, destination, configuration)
+	if err != nil || len(first.Variants) != 2 {
+		t.Fatalf("published %+v, %v", first, err)
+	}
+	// A variant that is already there is not made again
+	marked := destination.Directory + first.Variants[0].Name
+	err = ioutil.WriteFile(marked, []byte("made by the first run"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := publishImage(source, mediaDirectory, destination, configuration)
+	if err != nil || !reflect.DeepEqual(second, first) {
+		t.Errorf("the second run published %+v, %v, want %+v", second, err, first)
+	}
+	if contents, _ := ioutil.ReadFile(marked); string(contents) != "made by the first run" {
+		t.Errorf("the second run made %s again", first.Variants[0].Name)
+	}
+
+	// Other settings make other variants
+	for _, changed := range []Configuration{{ImageWidths: []int{50, 1600}, ImageQuality: 60}, {ImageWidths: []int{60, 1600}, ImageQuality: 85}} {
+		published, err := publishImage(source, mediaDirectory, destination, changed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if published.Name == first.Name {
+			t.Errorf("quality %d and widths %v reused %s", changed.ImageQuality, changed.ImageWidths, first.Name)
+		}
+	}
+	// The order of the widths does not matter
+	reordered, err := publishImage(source, mediaDirectory, destination, Configuration{ImageWidths: []int{1600, 50}, ImageQuality: 85})
+	if err != nil || reordered.Name != first.Name {
+		t.Errorf("reordered widths published %s, %v, want %s", reordered.Name, err, first.Name)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Where the converters put the images embedded in a docx file, next to the markdown file they write.
+// Images keep their place in the archive, e.g. <markdown>_media/media/image3.jpeg.
+func docxMediaDirectory(markdownFilePath string) string {
+	return strings.TrimSuffix(markdownFilePath, filepath.Ext(markdownFilePath)) + "_media"
+}
+
+// Copy the images embedded in a docx file, word/media/ in the archive, into directory/media/ the way
+// pandoc's --extract-media does
+func extractDocxMedia(docxFilePath string, directory string) error {
+	archive, err := zip.OpenReader(docxFilePath)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	for _, file := range archive.File {
+		name := path.Clean(file.Name)
+		if !strings.HasPrefix(name, "word/media/") || file.FileInfo().IsDir() {
+			continue
+		}
+		contents, err := file.Open()
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadAll(contents)
+		contents.Close()
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", file.Name, err)
+		}
+		mediaPath := filepath.Join(directory, filepath.FromSlash(strings.TrimPrefix(name, "word/")))
+		err = os.MkdirAll(filepath.Dir(mediaPath), 0755)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(mediaPath, data, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Where an article's images go and how the article refers to them: next to the index of a page bundle,
+// otherwise in static/images/ where hugo serves them from /images/
+type imageDestination struct {
+	Directory string
+	URL       string
+}
+
+func articleImageDestination(markdownPath string, hugoDirectory string) imageDestination {
+	if path.Base(markdownPath) == "index.md" {
+		return imageDestination{Directory: path.Dir(markdownPath) + "/", URL: ""}
+	}
+	return imageDestination{Directory: hugoDirectory + "static/images/", URL: "/images/"}
+}
+
+// The image an <img> tag or a markdown image refers to
+var imageSourceRegex = regexp.MustCompile(`<img\s[^>]*?src="([^"]+)"|!\[[^\]]*\]\(<?([^)\s>]+)>?`)
+
+func imageSource(line string) string {
+	match := imageSourceRegex.FindStringSubmatch(line)
+	if match == nil {
+		return ""
+	}
+	if match[1] != "" {
+		return match[1]
+	}
+	return match[2]
+}
+
+// An image on a line of an article: an <img> tag, or a markdown image with its alt text and source
+var inlineImageRegex = regexp.MustCompile(`<img\s[^>]*>|!\[([^\]]*)\]\(<?([^)\s>]+)>?(?:\s+"[^"]*")?\)`)
+
+var imageAttributeRegex = regexp.MustCompile(`\s(src|alt|width|height)="([^"]*)"`)
+
+// Point every image on a line at the copy publish gives it, an <img> tag with the inline-image class,
+// and keep the text around the images and the images publish gives no name as they are.
+// A lone image takes the caption for its alt text, returning whether it did.
+func rewriteInlineImages(line string, caption string, url string, publish func(source string) publishedImage) (string, bool) {
+	matches := inlineImageRegex.FindAllStringSubmatchIndex(line, -1)
+	var rewritten strings.Builder
+	captioned := false
+	last := 0
+	for _, match := range matches {
+		image := line[match[0]:match[1]]
+		attributes := make(map[string]string)
+		if strings.HasPrefix(image, "<img") {
+			for _, attribute := range imageAttributeRegex.FindAllStringSubmatch(image, -1) {
+				attributes[attribute[1]] = html.UnescapeString(attribute[2])
+			}
+		} else {
+			attributes["alt"] = unescapeMarkdown(line[match[2]:match[3]])
+			attributes["src"] = line[match[4]:match[5]]
+		}
+		rewritten.WriteString(line[last:match[0]])
+		last = match[1]
+		published := publish(attributes["src"])
+		if published.Name == "" {
+			rewritten.WriteString(image)
+			continue
+		}
+		alt := attributes["alt"]
+		if caption != "" && len(matches) == 1 {
+			alt = caption
+			captioned = true
+		}
+		// Images driveraker could not resize keep the size the document gave them
+		size := published.attributes(url)
+		if size == "" && attributes["width"] != "" && attributes["height"] != "" {
+			size = ` width="` + html.EscapeString(attributes["width"]) + `" height="` + html.EscapeString(attributes["height"]) + `"`
+		}
+		rewritten.WriteString(`<img src="` + html.EscapeString(url+published.Name) + `"` + size + ` alt="` + html.EscapeString(alt) + `" class="inline-image">`)
+	}
+	rewritten.WriteString(line[last:])
+	return rewritten.String(), captioned
+}
+
+// Publish an image the converter extracted into the hugo site under names made from its contents,
+// so a changed image never takes the place of one a published article shows. Images Go can decode
+// are resized and recompressed, see processImage, others are copied as they are.
+// Sources outside mediaDirectory, like images on the web, are not driveraker's to copy and give no name.
+func publishImage(source string, mediaDirectory string, destination imageDestination, configuration Configuration) (publishedImage, error) {
+	if strings.Contains(source, "://") {
+		return publishedImage{}, nil
+	}
+	source = filepath.FromSlash(source)
+	if !filepath.IsAbs(source) {
+		source = filepath.Join(mediaDirectory, source)
+	}
+	source = filepath.Clean(source)
+	if !strings.HasPrefix(source, filepath.Clean(mediaDirectory)+string(filepath.Separator)) {
+		return publishedImage{}, nil
+	}
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		return publishedImage{}, err
+	}
+	err = os.MkdirAll(destination.Directory, 0755)
+	if err != nil {
+		return publishedImage{}, err
+	}
+	published, processed, err := processImage(data, imageVariantKey(data, configuration.ImageWidths, configuration.ImageQuality), destination.Directory, configuration.ImageWidths, configuration.ImageQuality)
+	if err != nil || processed {
+		return published, err
+	}
+	sum := sha256.Sum256(data)
+	published = publishedImage{Name: hex.EncodeToString(sum[:8]) + imageExtension(source, data)}
+	imagePath := destination.Directory + published.Name
+	if copied, _ := exists(imagePath); copied {
+		return published, nil
+	}
+	return published, writeFileAtomic(imagePath, data, 0644)
+}
+
+// What the names of an image's variants start with: a hash of its contents and of the quality and widths
+// the variants are made with, so changing ImageQuality or ImageWidths makes new variants rather than
+// finding the ones made with the old settings
+func imageVariantKey(data []byte, widths []int, quality int) string {
+	sorted := append([]int(nil), widths...)
+	sort.Ints(sorted)
+	hash := sha256.New()
+	hash.Write(data)
+	fmt.Fprintf(hash, "\x00quality %d widths %v", quality, sorted)
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+// The extension of an image in lower case, or the one its contents call for when it has none
+func imageExtension(imagePath string, data []byte) string {
+	extension := strings.ToLower(filepath.Ext(imagePath))
+	if extension != "" {
+		return extension
+	}
+	return imageExtensions[http.DetectContentType(data)]
+}
+
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/bmp":  ".bmp",
+	"image/webp": ".webp",
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestRewriteInlineImages(t *testing.T) {
+	published := map[string]publishedImage{
+		"media/image1.png": {Name: "aaaa.png"},
+		"media/image2.jpg": {Name: "bbbb-960w.jpg", Width: 960, Height: 540, Variants: []imageVariant{{"bbbb-480w.jpg", 480, 270}, {"bbbb-960w.jpg", 960, 540}}},
+		"media/a&b.png":    {Name: "cccc.png"},
+	}
+	publish := func(source string) publishedImage {
+		return published[source]
+	}
+	for _, test := range []struct {
+		line, caption, want string
+		captioned           bool
+	}{
+		{
+			line:      `<img src="media/image1.png" alt="Picture 1" width="120" height="80" />`,
+			caption:   `Ben & Jerry's "best" <scoop>`,
+			want:      `<img src="/images/aaaa.png" width="120" height="80" alt="Ben &amp; Jerry&#39;s &#34;best&#34; &lt;scoop&gt;" class="inline-image">`,
+			captioned: true,
+		},
+		{
+			line:    `Before ![first](media/image1.png) between ![second](<media/image2.jpg> "Title") after`,
+			caption: "A caption for neither",
+			want:    `Before <img src="/images/aaaa.png" alt="first" class="inline-image"> between <img src="/images/bbbb-960w.jpg" srcset="/images/bbbb-480w.jpg 480w, /images/bbbb-960w.jpg 960w" sizes="(max-width: 960px) 100vw, 960px" width="960" height="540" alt="second" class="inline-image"> after`,
+		},
+		{
+			line: `![web](https://example.com/photo.png) and <img src="media/a&amp;b.png" alt="x &amp; y">`,
+			want: `![web](https://example.com/photo.png) and <img src="/images/cccc.png" alt="x &amp; y" class="inline-image">`,
+		},
+		{
+			line:    `![missing](media/image9.png)`,
+			caption: "Unused",
+			want:    `![missing](media/image9.png)`,
+		},
+	} {
+		got, captioned := rewriteInlineImages(test.line, test.caption, "/images/", publish)
+		if got != test.want || captioned != test.captioned {
+			t.Errorf("rewriting %s\ngot  %s, %v\nwant %s, %v", test.line, got, captioned, test.want, test.captioned)
+		}
+	}
+}
+
+// The caption is the line under the image only when it is a ##### heading
+func TestInlineImageCaptionLine(t *testing.T) {
+	caption, end, found := metadataLine([]string{"![one](media/image1.png)", "", "##### The caption", "", "More text"}, "#####", 1)
+	if !found || caption != "The caption" || end != 3 {
+		t.Errorf("caption %q ending at %d, %v", caption, end, found)
+	}
+	if _, _, found = metadataLine([]string{"![one](media/image1.png)", "", "Just text"}, "#####", 1); found {
+		t.Error("a paragraph was taken for a caption")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Exit status when another run holds the lock
+const exitLocked = 3
+
+// What the lock file says about the run holding it
+type lockInfo struct {
+	PID     int
+	Started time.Time
+	// The pipeline stage the run is in
+	Phase string
+}
+
+func (info lockInfo) String() string {
+	return fmt.Sprintf("PID %d, started %s, %s", info.PID, info.Started.Format(time.RFC1123), info.Phase)
+}
+
+// An flock on a file in the config directory keeps timer runs from overlapping.
+// The kernel releases the lock when its holder dies, so a crashed run never blocks the next one.
+type runLock struct {
+	file *os.File
+	info lockInfo
+}
+
+// Returned when another run holds the lock and we were not asked to wait
+type lockedError struct {
+	Holder lockInfo
+}
+
+func (err lockedError) Error() string {
+	return "another driveraker run is in progress (" + err.Holder.String() + ")"
+}
+
+// Take the run lock, either waiting for the current holder or failing with a lockedError
+func acquireRunLock(lockPath string, wait bool) (*runLock, error) {
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		holder, _ := readLockFile(f)
+		if holder.PID != 0 && !processRunning(holder.PID) {
+			fmt.Printf("[ERROR] The lock is held but PID %d is not running here, it may belong to another machine\n", holder.PID)
+		}
+		if !wait {
+			f.Close()
+			return nil, lockedError{holder}
+		}
+		fmt.Println("Waiting for the run in progress to finish (" + holder.String() + ")...")
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// A clean run empties the lock file on release, so anything still in it is from a run that died
+	if stale, err := readLockFile(f); err == nil && stale.PID != 0 {
+		fmt.Println("Taking over a stale lock from a run that did not finish (" + stale.String() + ")")
+	}
+	lock := &runLock{file: f, info: lockInfo{PID: os.Getpid(), Started: time.Now(), Phase: "starting"}}
+	err = lock.write()
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Record which stage of the pipeline the run is in
+func (lock *runLock) SetPhase(phase string) {
+	lock.info.Phase = phase
+	err := lock.write()
+	if err != nil {
+		fmt.Println("[ERROR] Error updating the lock file: ", err)
+	}
+}
+
+// The lock file is rewritten in place, replacing it would leave the flock on the old file
+func (lock *runLock) write() error {
+	contents, err := json.Marshal(lock.info)
+	if err != nil {
+		return err
+	}
+	err = lock.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = lock.file.WriteAt(append(contents, '\n'), 0)
+	return err
+}
+
+func (lock *runLock) Release() {
+	lock.file.Truncate(0)
+	syscall.Flock(int(lock.file.Fd()), syscall.LOCK_UN)
+	lock.file.Close()
+}
+
+func readLockFile(f *os.File) (lockInfo, error) {
+	var info lockInfo
+	_, err := f.Seek(0, 0)
+	if err != nil {
+		return info, err
+	}
+	contents, err := ioutil.ReadAll(f)
+	if err != nil || len(contents) == 0 {
+		return info, err
+	}
+	err = json.Unmarshal(contents, &info)
+	return info, err
+}
+
+// Report who holds the lock from what the lock file says, held is false when no run is in progress.
+// The file is read without an flock: even a shared one held for a moment makes a run starting at
+// that moment fail as if another run held the lock. A clean run empties the file on release and
+// a run that died left a PID that is not running, so a run is in progress when its PID is running.
+func readLockStatus(lockPath string) (info lockInfo, held bool, err error) {
+	contents, err := ioutil.ReadFile(lockPath)
+	if os.IsNotExist(err) {
+		return info, false, nil
+	}
+	if err != nil || len(contents) == 0 {
+		return info, false, err
+	}
+	err = json.Unmarshal(contents, &info)
+	if err != nil {
+		return info, false, err
+	}
+	return info, info.PID != 0 && processRunning(info.PID), nil
+}
+
+// Signal 0 checks whether a process exists without disturbing it
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
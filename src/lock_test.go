@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAcquireRunLock(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "driveraker.lock")
+	lock, err := acquireRunLock(lockPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, held, err := readLockStatus(lockPath)
+	if err != nil || !held || info.PID != os.Getpid() || info.Phase != "starting" {
+		t.Errorf("status while held is %+v, %v, %v", info, held, err)
+	}
+	lock.SetPhase("syncing")
+	if info, _, _ := readLockStatus(lockPath); info.Phase != "syncing" {
+		t.Errorf("the phase is %q", info.Phase)
+	}
+
+	// flock locks belong to the open file, so a second open in the same process is refused too
+	_, err = acquireRunLock(lockPath, false)
+	if locked, ok := err.(lockedError); !ok || locked.Holder.PID != os.Getpid() || locked.Holder.Phase != "syncing" {
+		t.Errorf("a second run got %v, want a lockedError naming the holder", err)
+	}
+
+	lock.Release()
+	info, held, err = readLockStatus(lockPath)
+	if err != nil || held || info.PID != 0 {
+		t.Errorf("status after release is %+v, %v, %v", info, held, err)
+	}
+	lock, err = acquireRunLock(lockPath, false)
+	if err != nil {
+		t.Fatalf("acquiring a released lock: %v", err)
+	}
+	lock.Release()
+}
+
+func TestAcquireRunLockWaits(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "driveraker.lock")
+	first, err := acquireRunLock(lockPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acquired := make(chan *runLock)
+	go func() {
+		second, err := acquireRunLock(lockPath, true)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- second
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("the waiting run took the lock while it was held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.Release()
+	select {
+	case second := <-acquired:
+		if second != nil {
+			if info, held, _ := readLockStatus(lockPath); !held || info.PID != os.Getpid() {
+				t.Errorf("the waiting run left %+v", info)
+			}
+			second.Release()
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiting run never took the released lock")
+	}
+}
+
+// Runs starting while status commands read the lock must never find it taken
+func TestReadLockStatusLeavesTheLockAlone(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "driveraker.lock")
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					readLockStatus(lockPath)
+				}
+			}
+		}()
+	}
+	defer close(done)
+	for i := 0; i < 2000; i++ {
+		lock, err := acquireRunLock(lockPath, false)
+		if err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+		lock.Release()
+	}
+}
+
+func TestReadLockStatusOfDeadRun(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "driveraker.lock")
+	if _, held, err := readLockStatus(lockPath); held || err != nil {
+		t.Errorf("a missing lock file gave %v, %v", held, err)
+	}
+	// A run that died leaves its PID behind, the PID of a finished child process is free
+	child, err := os.StartProcess("/bin/true", []string{"true"}, &os.ProcAttr{})
+	if err != nil {
+		t.Skip(err)
+	}
+	child.Wait()
+	contents, err := json.Marshal(lockInfo{PID: child.Pid, Started: time.Now(), Phase: "syncing"})
+	if err == nil {
+		err = ioutil.WriteFile(lockPath, contents, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, held, err := readLockStatus(lockPath)
+	if err != nil || held || info.PID != child.Pid {
+		t.Errorf("status of a dead run is %+v, %v, %v", info, held, err)
+	}
+	lock, err := acquireRunLock(lockPath, false)
+	if err != nil {
+		t.Fatalf("taking over the stale lock: %v", err)
+	}
+	lock.Release()
+}
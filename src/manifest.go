@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// Bump this and add a migration to readManifest when the layout of the manifest changes
+const manifestVersion = 1
+
+// The state driveraker keeps between runs at HashtablePath
+type Manifest struct {
+	Version int
+	// Cursor of the source to pass to the next sync
+	Cursor string
+	// Everything known about each document, keyed by document ID
+	Documents map[string]*ManifestEntry
+}
+
+type ManifestEntry struct {
+	// Path of the document within the source
+	SourcePath string
+	// When the source last saw the document change
+	SourceModified time.Time
+	// When the document was created, if the source knows
+	SourceCreated time.Time
+	// The latest docx export and its SHA-256
+	ExportPath   string
+	ExportSHA256 string
+	// SHA-256 of the exported docx the article was last converted from
+	ContentSHA256 string
+	// The generated article
+	MarkdownPath string
+	Slug         string
+	Section      string
+	// Where the article lived before a rename, until the renamed article is written
+	PreviousMarkdownPath string
+	// Old URLs of the article, hugo redirects them to the current one
+	Aliases []string
+	// Images copied into the hugo site for the article
+	Images []string
+	// When the article was last written and when that last made it into a deployed hugo build
+	Converted time.Time
+	LastBuild time.Time
+	// The workflow status of the published article, and the one the document's folder gives it
+	Status       string
+	FolderStatus string
+	// Where the article renders on the preview site
+	PreviewURL string
+	// When hugo starts showing the article, builds before a future publish date leave it out
+	PublishDate time.Time
+	// Why the last conversion of the document failed, empty once it converts
+	LastError string
+	// The document is gone from the source and its article waits to be unpublished
+	Deleted bool
+	// A change whose export could not be fetched and why, the next sync tries it again
+	Unfetched  *Document `json:",omitempty"`
+	FetchError string    `json:",omitempty"`
+}
+
+// Whether the latest export still has to be converted
+func (entry *ManifestEntry) Pending() bool {
+	if entry.Deleted || entry.ExportSHA256 == "" {
+		return false
+	}
+	return entry.ExportSHA256 != entry.ContentSHA256 || entry.PreviousMarkdownPath != ""
+}
+
+// Whether the article was written after the last hugo build, or its publish date passed since
+func (entry *ManifestEntry) Unbuilt() bool {
+	return entry.Converted.After(entry.LastBuild) || entry.Due(time.Now())
+}
+
+// Whether the article waits for a publish date still to come
+func (entry *ManifestEntry) Scheduled(now time.Time) bool {
+	return !entry.Deleted && !entry.Unpublished() && entry.PublishDate.After(now)
+}
+
+// Whether the article is a draft or in review, so hugo leaves it off the site
+func (entry *ManifestEntry) Unpublished() bool {
+	return entry.Status == statusDraft || entry.Status == statusReview
+}
+
+// Whether a scheduled article's publish date passed after the last hugo build, which left it out
+func (entry *ManifestEntry) Due(now time.Time) bool {
+	return !entry.Deleted && entry.PublishDate.After(entry.LastBuild) && !entry.PublishDate.After(now)
+}
+
+func (entry *ManifestEntry) article(id string) Article {
+	return Article{
+		Document: Document{
+			ID:         id,
+			Path:       entry.SourcePath,
+			ExportPath: entry.ExportPath,
+			Modified:   entry.SourceModified,
+			Created:    entry.SourceCreated,
+		},
+		Slug:                 entry.Slug,
+		Section:              entry.Section,
+		Aliases:              entry.Aliases,
+		MarkdownPath:         entry.MarkdownPath,
+		PreviousMarkdownPath: entry.PreviousMarkdownPath,
+		ContentSHA256:        entry.ExportSHA256,
+		Images:               entry.Images,
+	}
+}
+
+// Remember a document whose export could not be fetched, so the cursor can move on without losing it
+func (manifest *Manifest) markUnfetched(document Document, err error) {
+	entry := manifest.Documents[document.ID]
+	if entry == nil {
+		entry = &ManifestEntry{SourcePath: document.Path}
+		manifest.Documents[document.ID] = entry
+	}
+	entry.Unfetched = &document
+	entry.FetchError = err.Error()
+}
+
+// Changes to try fetching again, leaving out the documents the source reported anew
+func (manifest *Manifest) unfetchedChanges(changes []Change) []Change {
+	reported := make(map[string]bool)
+	for _, change := range changes {
+		reported[change.Document.ID] = true
+	}
+	var retries []Change
+	for _, id := range manifest.sortedIDs() {
+		if entry := manifest.Documents[id]; entry.Unfetched != nil && !entry.Deleted && !reported[id] {
+			retries = append(retries, Change{ChangeModified, *entry.Unfetched})
+		}
+	}
+	return retries
+}
+
+// Document IDs in a stable order
+func (manifest *Manifest) sortedIDs() []string {
+	var ids []string
+	for id := range manifest.Documents {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Documents synced but not converted yet, including ones whose conversion failed before
+func (manifest *Manifest) PendingArticles() (articles []Article) {
+	for _, id := range manifest.sortedIDs() {
+		if entry := manifest.Documents[id]; entry.Pending() {
+			articles = append(articles, entry.article(id))
+		}
+	}
+	return articles
+}
+
+// Documents deleted from the source whose articles are still up
+func (manifest *Manifest) PendingDeletions() (articles []Article) {
+	for _, id := range manifest.sortedIDs() {
+		if entry := manifest.Documents[id]; entry.Deleted {
+			articles = append(articles, entry.article(id))
+		}
+	}
+	return articles
+}
+
+// Documents converted since the last hugo build
+func (manifest *Manifest) unbuilt() (ids []string) {
+	for _, id := range manifest.sortedIDs() {
+		if manifest.Documents[id].Unbuilt() {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Articles waiting for their publish date, the soonest first
+func (manifest *Manifest) scheduled(now time.Time) (ids []string) {
+	for _, id := range manifest.sortedIDs() {
+		if manifest.Documents[id].Scheduled(now) {
+			ids = append(ids, id)
+		}
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		return manifest.Documents[ids[i]].PublishDate.Before(manifest.Documents[ids[j]].PublishDate)
+	})
+	return ids
+}
+
+// The next publish date a build has to wait for
+func (manifest *Manifest) nextScheduled(now time.Time) (time.Time, bool) {
+	scheduled := manifest.scheduled(now)
+	if len(scheduled) == 0 {
+		return time.Time{}, false
+	}
+	return manifest.Documents[scheduled[0]].PublishDate, true
+}
+
+// Record a successful hugo build of everything converted so far
+func (manifest *Manifest) markBuilt(built time.Time) {
+	for _, id := range manifest.unbuilt() {
+		manifest.Documents[id].LastBuild = built
+	}
+}
+
+func NewManifest() *Manifest {
+	return &Manifest{Version: manifestVersion, Documents: make(map[string]*ManifestEntry)}
+}
+
+// Read the manifest, starting a new one if there is none yet and migrating older state files
+func readManifest(manifestPath string) (*Manifest, error) {
+	contents, err := ioutil.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		return NewManifest(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(contents, &fields)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", manifestPath, err)
+	}
+	if _, isHashTable := fields["Items"]; isHashTable {
+		fmt.Println("Migrating the hashtable at " + manifestPath + " to a manifest...")
+		manifest, err := migrateHashTable(contents)
+		if err != nil {
+			return nil, fmt.Errorf("migrating %s: %v", manifestPath, err)
+		}
+		return manifest, nil
+	}
+	manifest := NewManifest()
+	err = json.Unmarshal(contents, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", manifestPath, err)
+	}
+	if manifest.Version > manifestVersion {
+		return nil, fmt.Errorf("%s has manifest version %d but this driveraker only knows up to version %d", manifestPath, manifest.Version, manifestVersion)
+	}
+	if manifest.Documents == nil {
+		manifest.Documents = make(map[string]*ManifestEntry)
+	}
+	manifest.Version = manifestVersion
+	return manifest, nil
+}
+
+// Save the manifest atomically, keeping the previous one as a backup
+func (manifest *Manifest) Save(manifestPath string) error {
+	contents, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	previous, err := ioutil.ReadFile(manifestPath)
+	if err == nil && json.Valid(previous) {
+		err = writeFileAtomic(manifestPath+".bak", previous, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(manifestPath, contents, 0644)
+}
+
+// The state file used to be a JSON serialized hashtable of linked lists with the paths of
+// the synced docx files relative to the sync directory for both keys and values.
+// Those paths are the document IDs of the drive CLI source.
+type legacyHashTable struct {
+	Items []*struct {
+		First *legacyHashTableNode
+	}
+}
+
+type legacyHashTableNode struct {
+	Value struct {
+		Key   string
+		Value string
+	}
+	Next *legacyHashTableNode
+}
+
+func migrateHashTable(contents []byte) (*Manifest, error) {
+	var table legacyHashTable
+	err := json.Unmarshal(contents, &table)
+	if err != nil {
+		return nil, err
+	}
+	manifest := NewManifest()
+	for _, list := range table.Items {
+		if list == nil {
+			continue
+		}
+		for node := list.First; node != nil; node = node.Next {
+			manifest.Documents[node.Value.Key] = &ManifestEntry{SourcePath: node.Value.Value}
+		}
+	}
+	return manifest, nil
+}
+
+// Hash the exported docx so unchanged documents are not converted again
+func hashFile(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// A hashtable as the first driveraker saved it: the buckets are linked lists keeping their last
+// node too, and both keys and values are the paths of the synced docx files
+const baselineHashTable = `{"Size":3,"Capacity":30,"Items":[` +
+	`{"First":{"Value":{"Key":"News/Story_exports/Story.docx","Value":"News/Story_exports/Story.docx"},"Next":{"Value":{"Key":"News/Other_exports/Other.docx","Value":"News/Other_exports/Other.docx"},"Next":null}},` +
+	`"Last":{"Value":{"Key":"News/Other_exports/Other.docx","Value":"News/Other_exports/Other.docx"},"Next":null},"Size":2},` +
+	`null,` +
+	`{"First":null,"Last":null,"Size":0},` +
+	`{"First":{"Value":{"Key":"Sports/Game_exports/Game.docx","Value":"Sports/Game_exports/Game.docx"},"Next":null},` +
+	`"Last":{"Value":{"Key":"Sports/Game_exports/Game.docx","Value":"Sports/Game_exports/Game.docx"},"Next":null},"Size":1}]}`
+
+func TestReadManifestMigratesHashTable(t *testing.T) {
+	manifestPath := filepath.Join(t.TempDir(), "driveraker.db")
+	err := ioutil.WriteFile(manifestPath, []byte(baselineHashTable), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := readManifest(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := manifest.sortedIDs()
+	if len(ids) != 3 || ids[0] != "News/Other_exports/Other.docx" || ids[1] != "News/Story_exports/Story.docx" || ids[2] != "Sports/Game_exports/Game.docx" {
+		t.Fatalf("migrated %q", ids)
+	}
+	for _, id := range ids {
+		entry := manifest.Documents[id]
+		if entry.SourcePath != id || entry.Pending() || entry.Deleted {
+			t.Errorf("%s migrated to %+v", id, entry)
+		}
+	}
+	if manifest.Version != manifestVersion || manifest.Cursor != "" {
+		t.Errorf("version %d and cursor %q", manifest.Version, manifest.Cursor)
+	}
+
+	// Saved, it reads back as a manifest and the hashtable stays as the backup
+	err = manifest.Save(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := readManifest(manifestPath)
+	if err != nil || len(saved.Documents) != 3 || saved.Documents["Sports/Game_exports/Game.docx"].SourcePath != "Sports/Game_exports/Game.docx" {
+		t.Errorf("read back %+v, %v", saved, err)
+	}
+	if backup, _ := ioutil.ReadFile(manifestPath + ".bak"); string(backup) != baselineHashTable {
+		t.Errorf("the backup is %s", backup)
+	}
+}
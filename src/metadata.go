@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The DRVRKR_ keys driveraker reads itself
+var builtinMetadataKeys = map[string]bool{
+	"TAGS":        true,
+	"CATEGORIES":  true,
+	"PUB_DATE":    true,
+	"UPDATE_DATE": true,
+	"STATUS":      true,
+}
+
+// A `DRVRKR_KEY: value` line, pandoc escapes the underscores as \_ but a document may not
+var metadataLineRegex = regexp.MustCompile(`^DRVRKR((?:\\?_[A-Za-z0-9]+)+)\s*:\s*(.*)$`)
+
+// Custom keys are upper case words joined by underscores, without the DRVRKR_ prefix
+var metadataKeyRegex = regexp.MustCompile(`^[A-Z0-9]+(_[A-Z0-9]+)*$`)
+
+// The metadata block at the top of a document
+type DocumentMetadata struct {
+	// Values by key, without the DRVRKR_ prefix
+	Values map[string]string
+	// Keys in the order they appear
+	Keys []string
+	// The number of lines the block takes up, blank lines included
+	Lines int
+}
+
+// Read the metadata at the top of a document: DRVRKR_ lines in any order with blank lines between them,
+// and two column tables of keys and values, which pandoc writes as HTML. The block ends at the first other line.
+func parseMetadataBlock(lines []string, customKeys map[string]string) DocumentMetadata {
+	metadata := DocumentMetadata{Values: make(map[string]string)}
+	for i := 0; i < len(lines); {
+		line := strings.TrimSpace(lines[i])
+		if line == "" {
+			i++
+			continue
+		}
+		if match := metadataLineRegex.FindStringSubmatch(line); match != nil {
+			metadata.add(metadataKey(match[1]), match[2])
+			i++
+			metadata.Lines = i
+			continue
+		}
+		rows, header, end := metadataTable(lines, i)
+		// A header row names the columns, like Key and Value, unless it holds a key itself
+		if header && (len(rows[0]) == 0 || !knownMetadataKey(metadataKey(rows[0][0]), customKeys)) {
+			rows = rows[1:]
+		}
+		if !isMetadataTable(rows, customKeys) {
+			break
+		}
+		for _, row := range rows {
+			metadata.add(metadataKey(row[0]), row[1])
+		}
+		i = end
+		metadata.Lines = i
+	}
+	return metadata
+}
+
+func (metadata *DocumentMetadata) add(key string, value string) {
+	if _, duplicate := metadata.Values[key]; !duplicate {
+		metadata.Keys = append(metadata.Keys, key)
+	}
+	metadata.Values[key] = strings.TrimSpace(value)
+}
+
+// The key of a metadata line or table row: "DRVRKR\_PUB\_DATE", "PUB_DATE" and "Pub date:" are all PUB_DATE
+func metadataKey(text string) string {
+	key := strings.TrimSuffix(strings.TrimSpace(strings.Replace(text, `\_`, "_", -1)), ":")
+	key = strings.TrimPrefix(strings.TrimPrefix(strings.ToUpper(key), "DRVRKR"), "_")
+	return strings.Join(strings.Fields(key), "_")
+}
+
+var (
+	tableRowRegex  = regexp.MustCompile(`(?s)<tr[^>]*>(.*?)</tr>`)
+	tableCellRegex = regexp.MustCompile(`(?s)<t[dh][^>]*>(.*?)</t[dh]>`)
+	htmlTagRegex   = regexp.MustCompile(`<[^>]+>`)
+	// The |---|---| line under a pipe table's header
+	pipeTableRuleRegex = regexp.MustCompile(`^\|?[\s:|-]+$`)
+)
+
+// Read the rows of an HTML or pipe table starting at line start, returning whether the first row
+// is a header and the line after the table. No rows means there is no table there.
+func metadataTable(lines []string, start int) (rows [][]string, header bool, end int) {
+	line := strings.TrimSpace(lines[start])
+	switch {
+	case strings.HasPrefix(line, "<table"):
+		end = start
+		for end < len(lines) && !strings.Contains(lines[end], "</table>") {
+			end++
+		}
+		if end == len(lines) {
+			return nil, false, start
+		}
+		end++
+		table := strings.Join(lines[start:end], "\n")
+		for i, row := range tableRowRegex.FindAllStringSubmatch(table, -1) {
+			if strings.Contains(row[1], "<th") {
+				if i > 0 {
+					continue
+				}
+				header = true
+			}
+			var cells []string
+			for _, cell := range tableCellRegex.FindAllStringSubmatch(row[1], -1) {
+				text := html.UnescapeString(htmlTagRegex.ReplaceAllString(cell[1], " "))
+				cells = append(cells, strings.Join(strings.Fields(text), " "))
+			}
+			rows = append(rows, cells)
+		}
+	case strings.HasPrefix(line, "|"):
+		end = start
+		for ; end < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[end]), "|"); end++ {
+			row := strings.TrimSpace(lines[end])
+			if pipeTableRuleRegex.MatchString(row) {
+				continue
+			}
+			if end+1 < len(lines) && pipeTableRuleRegex.MatchString(strings.TrimSpace(lines[end+1])) {
+				header = len(rows) == 0
+			}
+			cells := strings.Split(strings.Trim(row, "|"), "|")
+			for j := range cells {
+				cells[j] = strings.TrimSpace(cells[j])
+			}
+			rows = append(rows, cells)
+		}
+	}
+	return rows, header, end
+}
+
+// A metadata table has two columns and at least one key driveraker knows,
+// so a table of the article itself is left alone
+func isMetadataTable(rows [][]string, customKeys map[string]string) bool {
+	known := false
+	for _, row := range rows {
+		if len(row) != 2 {
+			return false
+		}
+		if knownMetadataKey(metadataKey(row[0]), customKeys) {
+			known = true
+		}
+	}
+	return known
+}
+
+// Whether a key is driveraker's own or configured in MetadataKeys
+func knownMetadataKey(key string, customKeys map[string]string) bool {
+	_, custom := customKeys[key]
+	return builtinMetadataKeys[key] || custom
+}
+
+// The keys that are neither driveraker's own nor configured in MetadataKeys
+func (metadata DocumentMetadata) unknownKeys(customKeys map[string]string) (unknown []string) {
+	for _, key := range metadata.Keys {
+		if !knownMetadataKey(key, customKeys) {
+			unknown = append(unknown, key)
+		}
+	}
+	return unknown
+}
+
+// The front matter of the custom keys a document sets
+func (metadata DocumentMetadata) params(customKeys map[string]string) map[string]interface{} {
+	params := make(map[string]interface{})
+	for _, key := range metadata.Keys {
+		if frontMatterKey, custom := customKeys[key]; custom {
+			params[frontMatterKey] = metadataValue(metadata.Values[key])
+		}
+	}
+	return params
+}
+
+// Numbers and booleans stay typed in the front matter, so DRVRKR_WEIGHT: 3 sorts as a number
+func metadataValue(value string) interface{} {
+	value = unescapeMarkdown(value)
+	switch {
+	case value == "true" || value == "false":
+		return value == "true"
+	case numberRegex.MatchString(value):
+		return json.Number(value)
+	}
+	return value
+}
+
+// Check the MetadataKeys setting
+func validateMetadataKeys(customKeys map[string]string) (errs configErrors) {
+	var keys []string
+	for key := range customKeys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch {
+		case !metadataKeyRegex.MatchString(key):
+			errs.add("MetadataKeys: %q must be upper case words joined by underscores, like SERIES for DRVRKR_SERIES", key)
+		case builtinMetadataKeys[key]:
+			errs.add("MetadataKeys: DRVRKR_%s is read by driveraker itself", key)
+		}
+		if customKeys[key] == "" {
+			errs.add("MetadataKeys: %q needs a front matter key", key)
+		}
+	}
+	return errs
+}
+
+// Warn about keys a document sets that nothing reads, usually typos
+func reportUnknownMetadata(metadata DocumentMetadata, customKeys map[string]string, markdownFilePath string) {
+	for _, key := range metadata.unknownKeys(customKeys) {
+		fmt.Println("[WARNING] Unknown metadata key DRVRKR_" + key + " in " + markdownFilePath + ", add it to MetadataKeys to use it")
+	}
+}
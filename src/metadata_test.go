@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMetadataBlock(t *testing.T) {
+	customKeys := map[string]string{"SERIES": "series", "WEIGHT": "weight"}
+	for _, test := range []struct {
+		name     string
+		document string
+		// Keys in order with their values, and how many lines the block takes up
+		want  []string
+		lines int
+	}{
+		{
+			"escaped lines in any order",
+			"DRVRKR\\_UPDATE\\_DATE: 2017-05-05\n\nDRVRKR\\_TAGS: news, local\nDRVRKR\\_PUB\\_DATE: 2017-05-04\n\n# The headline",
+			[]string{"UPDATE_DATE=2017-05-05", "TAGS=news, local", "PUB_DATE=2017-05-04"},
+			4,
+		},
+		{
+			"unescaped lines",
+			"DRVRKR_CATEGORIES:news\nDRVRKR_STATUS : draft\nThe story starts.",
+			[]string{"CATEGORIES=news", "STATUS=draft"},
+			2,
+		},
+		{
+			"custom keys",
+			"DRVRKR\\_SERIES: Elections\nDRVRKR_WEIGHT: 3\nText",
+			[]string{"SERIES=Elections", "WEIGHT=3"},
+			2,
+		},
+		{
+			"HTML table",
+			"<table>\n<thead>\n<tr class=\"header\">\n<th>Key</th>\n<th>Value</th>\n</tr>\n</thead>\n<tbody>\n" +
+				"<tr class=\"odd\">\n<td>DRVRKR_TAGS</td>\n<td><p>news</p></td>\n</tr>\n" +
+				"<tr class=\"even\">\n<td>Pub date:</td>\n<td>May 4, 2017</td>\n</tr>\n</tbody>\n</table>\n\nText",
+			[]string{"TAGS=news", "PUB_DATE=May 4, 2017"},
+			18,
+		},
+		{
+			"pipe table",
+			"| Key | Value |\n|---|---|\n| DRVRKR\\_SERIES | Elections |\n| Status | review |\n\nText",
+			[]string{"SERIES=Elections", "STATUS=review"},
+			4,
+		},
+		{
+			"table whose first row is a key",
+			"| DRVRKR_TAGS | news |\n|---|---|\n| DRVRKR_STATUS | draft |\nText",
+			[]string{"TAGS=news", "STATUS=draft"},
+			3,
+		},
+		{
+			"HTML table whose header row is a key",
+			"<table>\n<tr><th>DRVRKR_CATEGORIES</th><th>sports</th></tr>\n<tr><td>DRVRKR_TAGS</td><td>game</td></tr>\n</table>",
+			[]string{"CATEGORIES=sports", "TAGS=game"},
+			4,
+		},
+		{
+			"lines and a table",
+			"DRVRKR_PUB_DATE: 2017-05-04\n\n| DRVRKR_TAGS | news |\n\nDRVRKR_STATUS: published\nText",
+			[]string{"PUB_DATE=2017-05-04", "TAGS=news", "STATUS=published"},
+			5,
+		},
+		{
+			"a table of the article",
+			"| Team | Score |\n|---|---|\n| Home | 3 |\n",
+			nil,
+			0,
+		},
+		{
+			"a table of three columns",
+			"| DRVRKR_TAGS | news | extra |\n",
+			nil,
+			0,
+		},
+		{
+			"no metadata",
+			"The story starts.\nDRVRKR_TAGS: too late",
+			nil,
+			0,
+		},
+	} {
+		metadata := parseMetadataBlock(strings.Split(test.document, "\n"), customKeys)
+		var got []string
+		for _, key := range metadata.Keys {
+			got = append(got, key+"="+metadata.Values[key])
+		}
+		if !reflect.DeepEqual(got, test.want) || metadata.Lines != test.lines {
+			t.Errorf("%s: got %q over %d lines, want %q over %d", test.name, got, metadata.Lines, test.want, test.lines)
+		}
+	}
+}
+
+func TestMetadataUnknownKeys(t *testing.T) {
+	customKeys := map[string]string{"SERIES": "series"}
+	metadata := parseMetadataBlock([]string{"DRVRKR_TAG: typo", "DRVRKR_SERIES: Elections", "DRVRKR_TAGS: news", "DRVRKR_PUBDATE: 2017-05-04"}, customKeys)
+	if got, want := metadata.unknownKeys(customKeys), []string{"TAG", "PUBDATE"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unknown keys %q, want %q", got, want)
+	}
+	// A table with no key driveraker knows is part of the article
+	metadata = parseMetadataBlock([]string{"| DRVRKR_TAG | typo |", "Text"}, customKeys)
+	if len(metadata.Keys) != 0 || metadata.Lines != 0 {
+		t.Errorf("a table of unknown keys was read as metadata: %+v", metadata)
+	}
+}
+
+func TestMetadataParams(t *testing.T) {
+	customKeys := map[string]string{"SERIES": "series", "WEIGHT": "weight", "FEATURED": "featured"}
+	metadata := parseMetadataBlock([]string{"DRVRKR_SERIES: Bob's \\*best\\*", "DRVRKR_WEIGHT: 3", "DRVRKR_FEATURED: true", "DRVRKR_TAGS: news"}, customKeys)
+	want := map[string]interface{}{"series": "Bob's *best*", "weight": metadataValue("3"), "featured": true}
+	if got := metadata.params(customKeys); !reflect.DeepEqual(got, want) {
+		t.Errorf("params %#v, want %#v", got, want)
+	}
+}
+
+func TestValidateMetadataKeys(t *testing.T) {
+	errs := validateMetadataKeys(map[string]string{"SERIES": "series", "series": "series", "TAGS": "tags", "EMPTY": ""})
+	want := []string{`"EMPTY" needs a front matter key`, "DRVRKR_TAGS is read by driveraker itself", `"series" must be upper case words`}
+	if len(errs) != len(want) {
+		t.Fatalf("got %q", errs)
+	}
+	for i, err := range errs {
+		if !strings.Contains(err, want[i]) {
+			t.Errorf("error %d is %q, want %s", i, err, want[i])
+		}
+	}
+}
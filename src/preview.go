@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The preview build goes here inside the hugo site, next to hugo's public/
+const previewBuildDirectory = "preview/"
+
+// Whether the site has a preview build
+func previewEnabled(configuration Configuration) bool {
+	return configuration.PreviewDirectory != ""
+}
+
+// Compile every article, drafts and future publish dates included, for editors to review at the preview URL.
+// Nothing but hugo writes to the preview build, so it is cleaned of pages whose articles are gone.
+func compilePreviewSite(hugoDirectory string, previewBaseURL string) error {
+	compile := exec.Command("/usr/bin/hugo", "--buildDrafts", "--buildFuture", "--buildExpired", "--cleanDestinationDir", "--baseURL", previewBaseURL, "--destination", hugoDirectory+previewBuildDirectory)
+	compile.Dir = hugoDirectory
+	out, err := compile.Output()
+	fmt.Println("hugo preview: ", string(out))
+	if err != nil {
+		return fmt.Errorf("compiling the preview with hugo: %v", err)
+	}
+	return nil
+}
+
+// Copy the preview build to the preview directory with the same script as the production site
+func publishPreviewSite(hugoDirectory string, previewDirectory string, copyHugoSiteToProductionPath string) error {
+	publish := exec.Command("/bin/bash", copyHugoSiteToProductionPath, hugoDirectory+previewBuildDirectory, previewDirectory)
+	publish.Dir = "/"
+	fmt.Println("Copying hugo compiled preview to the preview directory...")
+	out, err := publish.Output()
+	fmt.Print("copying hugo preview: " + string(out))
+	if err != nil {
+		return fmt.Errorf("copying the hugo preview: %v", err)
+	}
+	return nil
+}
+
+// Where an article renders on the preview site
+func previewURL(configuration Configuration, slug string, section string) string {
+	return strings.TrimSuffix(configuration.PreviewBaseURL, "/") + slugURL(slug, section)
+}
+
+// Build the preview and copy it to the preview directory
+func runPreview(s *session) error {
+	if !previewEnabled(s.configuration) {
+		return fmt.Errorf("there is no preview build, set PreviewDirectory and PreviewBaseURL")
+	}
+	s.setPhase("building the preview")
+	err := compilePreviewSite(s.configuration.HugoPostDirectory, s.configuration.PreviewBaseURL)
+	if err != nil {
+		return err
+	}
+	s.setPhase("deploying the preview")
+	return publishPreviewSite(s.configuration.HugoPostDirectory, s.configuration.PreviewDirectory, s.copyHugoSiteScript)
+}
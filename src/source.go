@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A document as seen by a source backend
+type Document struct {
+	// Stable identifier of the document, the relative path when the backend has nothing better
+	ID string
+	// Path of the document relative to the root of the source
+	Path string
+	// Local path to the exported docx file once it has been fetched
+	ExportPath string
+	// When the source last saw the document change
+	Modified time.Time
+	// When the document was created, zero when the source cannot tell
+	Created time.Time
+}
+
+type ChangeKind int
+
+const (
+	ChangeAdded ChangeKind = iota
+	ChangeModified
+	ChangeDeleted
+	// The document was renamed or moved to another folder
+	ChangeMoved
+)
+
+func (kind ChangeKind) String() string {
+	switch kind {
+	case ChangeAdded:
+		return "added"
+	case ChangeModified:
+		return "modified"
+	case ChangeDeleted:
+		return "deleted"
+	case ChangeMoved:
+		return "moved"
+	}
+	return "unknown"
+}
+
+// A change to a document reported by a source
+type Change struct {
+	Kind     ChangeKind
+	Document Document
+}
+
+// A Source is where driveraker pulls its documents from
+type Source interface {
+	// List every document the source currently holds
+	ListDocuments() ([]Document, error)
+	// Make sure a docx export of the document exists locally and return its path
+	FetchExport(document Document) (string, error)
+	// Report the changes since cursor along with the cursor for the next call,
+	// an empty cursor means everything is new
+	Changes(cursor string) ([]Change, string, error)
+	// Remember what the source needs to interpret the next changes. Called once the manifest
+	// holding the cursor is saved, so a failed save leaves both where they were.
+	SaveState() error
+}
+
+// Pick the source backend named in the configuration.
+// Sources only remember what they reported in SaveState, which a dry run never calls.
+func newSource(configuration Configuration, dryRun bool) (Source, error) {
+	switch configuration.Source {
+	case "", "drive":
+		return &driveCLISource{
+			Binary:          "/usr/bin/drive",
+			SyncDirectory:   configuration.DriveSyncDirectory,
+			RemoteDirectory: configuration.GoogleDriveRemoteDirectory,
+		}, nil
+	case "api":
+		source, err := newDriveAPISource(configuration)
+		if err != nil {
+			return nil, err
+		}
+		return source, nil
+	case "local":
+		return &localSource{Directory: configuration.DriveSyncDirectory, StatePath: configuration.HashtablePath + ".local"}, nil
+	}
+	return nil, fmt.Errorf("unknown source %q", configuration.Source)
+}
+
+// The drive CLI mirrors the remote directory into the sync directory
+// and exports every Google Document to docx as it goes.
+// Its output only names paths, so a document's ID is the path of its export and a renamed or moved
+// document shows up as deleted and added. It never reports ChangeMoved and gives renamed articles no aliases.
+type driveCLISource struct {
+	Binary          string
+	SyncDirectory   string
+	RemoteDirectory string
+}
+
+// Every export the drive CLI has made lives in a "<name>_exports" directory
+func (source *driveCLISource) ListDocuments() ([]Document, error) {
+	var documents []Document
+	root := filepath.Join(source.SyncDirectory, source.RemoteDirectory)
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(filePath, ".docx") || !strings.HasSuffix(filepath.Dir(filePath), "_exports") {
+			return nil
+		}
+		relativePath := shortenPath(filePath, source.SyncDirectory)
+		documents = append(documents, Document{
+			ID:         relativePath,
+			Path:       relativePath,
+			ExportPath: filePath,
+			Modified:   info.ModTime(),
+		})
+		return nil
+	})
+	return documents, err
+}
+
+// drive pull already exported the document, so just check it is there
+func (source *driveCLISource) FetchExport(document Document) (string, error) {
+	if _, err := os.Stat(document.ExportPath); err != nil {
+		return "", err
+	}
+	return document.ExportPath, nil
+}
+
+// The drive CLI has no notion of a cursor, a pull always brings the local mirror up to date
+func (source *driveCLISource) Changes(cursor string) ([]Change, string, error) {
+	pull := exec.Command(source.Binary, "pull", "-no-prompt", "-desktop-links=false", "-export", "docx", source.RemoteDirectory)
+	pull.Dir = source.SyncDirectory
+	fmt.Println("Syncing Google Drive...")
+	out, err := pull.Output()
+	if err != nil {
+		return nil, cursor, err
+	}
+	fmt.Print("drive: " + string(out))
+	fmt.Println("Done syncing!")
+	return interpretDriveOutput(string(out), source.SyncDirectory), cursor, nil
+}
+
+// The local mirror is all the state the drive CLI keeps
+func (source *driveCLISource) SaveState() error {
+	return nil
+}
+
+// A plain directory of docx files, useful for running the pipeline without Google credentials
+type localSource struct {
+	Directory string
+	// Remembers which documents were seen last time so deletions can be noticed
+	StatePath string
+	// The files of the last scan, waiting for SaveState
+	seen map[string]localFile
+}
+
+// What the local source remembers of a file: the document it holds and where it was
+type localFile struct {
+	ID   string
+	Path string
+}
+
+// Renaming or moving a file keeps its inode, so that makes for a stable key. Editors that save to a
+// temporary file and rename it over the document, and rsync, give it a new inode, resolveLocalIDs
+// recognises those by their path.
+func fileID(info os.FileInfo, relativePath string) string {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("inode-%d-%d", stat.Dev, stat.Ino)
+	}
+	return relativePath
+}
+
+// The files seen last time, by key
+func (source *localSource) readState() (map[string]localFile, error) {
+	var files map[string]localFile
+	contents, err := ioutil.ReadFile(source.StatePath)
+	if os.IsNotExist(err) {
+		return files, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(contents, &files)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %v", source.StatePath, err)
+	}
+	return files, nil
+}
+
+// The docx files in the directory along with their keys
+func (source *localSource) scan() (documents []Document, keys []string, err error) {
+	err = filepath.Walk(source.Directory, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip directories and the lock files word processors leave behind
+		if info.IsDir() || !strings.HasSuffix(filePath, ".docx") || strings.HasPrefix(info.Name(), "~$") {
+			return nil
+		}
+		relativePath := shortenPath(filePath, source.Directory)
+		documents = append(documents, Document{
+			Path:       relativePath,
+			ExportPath: filePath,
+			Modified:   info.ModTime(),
+		})
+		keys = append(keys, fileID(info, relativePath))
+		return nil
+	})
+	return documents, keys, err
+}
+
+// Give each scanned document the ID its file had last time, or the one of the file that was at its path
+// when that file is gone, and return what to remember of the files
+func resolveLocalIDs(documents []Document, keys []string, files map[string]localFile) map[string]localFile {
+	listed := make(map[string]bool)
+	for _, key := range keys {
+		listed[key] = true
+	}
+	// IDs of the files that are gone, by the path they were at
+	replaced := make(map[string]string)
+	used := make(map[string]bool)
+	for key, file := range files {
+		used[file.ID] = true
+		if !listed[key] {
+			replaced[file.Path] = file.ID
+		}
+	}
+	current := make(map[string]localFile)
+	for i, key := range keys {
+		document := &documents[i]
+		if file, known := files[key]; known {
+			document.ID = file.ID
+		} else if id, ok := replaced[document.Path]; ok {
+			document.ID = id
+			delete(replaced, document.Path)
+		} else {
+			// A new file can get the inode of one replaced earlier, whose ID lives on
+			document.ID = key
+			for n := 2; used[document.ID]; n++ {
+				document.ID = fmt.Sprintf("%s-%d", key, n)
+			}
+		}
+		used[document.ID] = true
+		current[key] = localFile{ID: document.ID, Path: document.Path}
+	}
+	return current
+}
+
+func (source *localSource) ListDocuments() ([]Document, error) {
+	files, err := source.readState()
+	if err != nil {
+		return nil, err
+	}
+	documents, keys, err := source.scan()
+	if err != nil {
+		return nil, err
+	}
+	resolveLocalIDs(documents, keys, files)
+	return documents, nil
+}
+
+// The documents already are docx files
+func (source *localSource) FetchExport(document Document) (string, error) {
+	if _, err := os.Stat(document.ExportPath); err != nil {
+		return "", err
+	}
+	return document.ExportPath, nil
+}
+
+// The cursor is the time of the last scan, anything modified after it has changed.
+// Documents seen last time but missing now were deleted.
+func (source *localSource) Changes(cursor string) ([]Change, string, error) {
+	scanned := time.Now()
+	var since time.Time
+	if cursor != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339Nano, cursor)
+		if err != nil {
+			return nil, cursor, fmt.Errorf("bad local source cursor %q: %v", cursor, err)
+		}
+	}
+	files, err := source.readState()
+	if err != nil {
+		return nil, cursor, err
+	}
+	documents, keys, err := source.scan()
+	if err != nil {
+		return nil, cursor, err
+	}
+	current := resolveLocalIDs(documents, keys, files)
+	// Document IDs mapped to their paths
+	seen := make(map[string]string)
+	for _, file := range files {
+		seen[file.ID] = file.Path
+	}
+	var changes []Change
+	for _, document := range documents {
+		previousPath, known := seen[document.ID]
+		switch {
+		case cursor == "" || !known:
+			changes = append(changes, Change{ChangeAdded, document})
+		case previousPath != document.Path:
+			changes = append(changes, Change{ChangeMoved, document})
+		case document.Modified.After(since):
+			changes = append(changes, Change{ChangeModified, document})
+		}
+		delete(seen, document.ID)
+	}
+	for id, previousPath := range seen {
+		changes = append(changes, Change{ChangeDeleted, Document{ID: id, Path: previousPath, ExportPath: filepath.Join(source.Directory, previousPath)}})
+	}
+	source.seen = current
+	return changes, scanned.Format(time.RFC3339Nano), nil
+}
+
+func (source *localSource) SaveState() error {
+	if source.seen == nil {
+		return nil
+	}
+	contents, err := json.Marshal(source.seen)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(source.StatePath, contents, 0644)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Scan a local source and save its state the way a sync does
+func scanLocal(t *testing.T, source *localSource, cursor string) ([]Change, string) {
+	changes, cursor, err := source.Changes(cursor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = source.SaveState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return changes, cursor
+}
+
+func writeDocx(t *testing.T, filePath string, modified time.Time) {
+	err := ioutil.WriteFile(filePath, []byte("docx"), 0644)
+	if err == nil {
+		err = os.Chtimes(filePath, modified, modified)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLocalSourceKeepsDocumentIDs(t *testing.T) {
+	directory := t.TempDir()
+	source := &localSource{Directory: directory + "/", StatePath: filepath.Join(t.TempDir(), "state.local")}
+	past := time.Now().Add(-time.Hour)
+	writeDocx(t, filepath.Join(directory, "story.docx"), past)
+	writeDocx(t, filepath.Join(directory, "other.docx"), past)
+	changes, cursor := scanLocal(t, source, "")
+	if got := changeSummary(changes); len(got) != 2 {
+		t.Fatalf("first scan %q", got)
+	}
+	ids := make(map[string]string)
+	for _, change := range changes {
+		ids[change.Document.Path] = change.Document.ID
+	}
+
+	// Saving through a temporary file gives the document a new inode at the same path
+	temporary := filepath.Join(directory, ".story.docx.tmp")
+	writeDocx(t, temporary, time.Now())
+	err := os.Rename(temporary, filepath.Join(directory, "story.docx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, cursor = scanLocal(t, source, cursor)
+	if len(changes) != 1 || changes[0].Kind != ChangeModified || changes[0].Document.ID != ids["story.docx"] {
+		t.Errorf("replaced document gave %q, want it modified under ID %s", changeSummary(changes), ids["story.docx"])
+	}
+	changes, cursor = scanLocal(t, source, cursor)
+	if len(changes) != 0 {
+		t.Errorf("unchanged documents gave %q", changeSummary(changes))
+	}
+
+	// Moving a document keeps its inode, and a new file taking its place is a new document
+	err = os.Rename(filepath.Join(directory, "other.docx"), filepath.Join(directory, "moved.docx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeDocx(t, filepath.Join(directory, "other.docx"), time.Now())
+	changes, _ = scanLocal(t, source, cursor)
+	kinds := make(map[string]ChangeKind)
+	for _, change := range changes {
+		kinds[change.Document.Path] = change.Kind
+		if change.Document.Path == "moved.docx" && change.Document.ID != ids["other.docx"] {
+			t.Errorf("moved document has ID %s, want %s", change.Document.ID, ids["other.docx"])
+		}
+	}
+	if want := map[string]ChangeKind{"moved.docx": ChangeMoved, "other.docx": ChangeAdded}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("move gave %q", changeSummary(changes))
+	}
+}
+
+func TestDriveCLIDryRunComparesTheMirror(t *testing.T) {
+	syncDirectory := t.TempDir() + "/"
+	past := time.Now().Add(-time.Hour)
+	for _, name := range []string{"Unchanged", "Edited", "New"} {
+		exportPath := filepath.Join(syncDirectory, "News", name+"_exports", name+".docx")
+		err := os.MkdirAll(filepath.Dir(exportPath), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeDocx(t, exportPath, past)
+	}
+	hash, err := hashFile(filepath.Join(syncDirectory, "News/Unchanged_exports/Unchanged.docx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := NewManifest()
+	manifest.Documents["News/Unchanged_exports/Unchanged.docx"] = &ManifestEntry{SourcePath: "News/Unchanged_exports/Unchanged.docx", ExportSHA256: hash}
+	manifest.Documents["News/Edited_exports/Edited.docx"] = &ManifestEntry{SourcePath: "News/Edited_exports/Edited.docx", ExportSHA256: "old"}
+	manifest.Documents["News/Gone_exports/Gone.docx"] = &ManifestEntry{SourcePath: "News/Gone_exports/Gone.docx", ExportSHA256: "old"}
+
+	// The binary is never run, a pull would fail
+	source, err := newSource(Configuration{Source: "drive", DriveSyncDirectory: syncDirectory, GoogleDriveRemoteDirectory: "News"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli := source.(*driveCLISource)
+	cli.Binary = filepath.Join(t.TempDir(), "no-drive")
+	changes, cursor, err := (&driveCLIDryRun{cli, manifest}).Changes("cursor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"modified News/Edited_exports/Edited.docx News/Edited_exports/Edited.docx",
+		"added News/New_exports/New.docx News/New_exports/New.docx",
+		"deleted News/Gone_exports/Gone.docx News/Gone_exports/Gone.docx",
+	}
+	if got := changeSummary(changes); !reflect.DeepEqual(got, want) || cursor != "cursor" {
+		t.Errorf("changes %q and cursor %q, want %q", got, cursor, want)
+	}
+}
+
+// A source that reports the same changes every sync
+type fixedSource struct {
+	changes []Change
+}
+
+func (source *fixedSource) ListDocuments() ([]Document, error) {
+	return nil, nil
+}
+
+func (source *fixedSource) FetchExport(document Document) (string, error) {
+	return document.ExportPath, nil
+}
+
+func (source *fixedSource) Changes(cursor string) ([]Change, string, error) {
+	return source.changes, cursor, nil
+}
+
+func (source *fixedSource) SaveState() error {
+	return nil
+}
+
+func TestSyncIgnoresDeletionsOfUnknownDocuments(t *testing.T) {
+	manifest := NewManifest()
+	manifest.Documents["known"] = &ManifestEntry{SourcePath: "Known", ExportSHA256: "hash", ContentSHA256: "hash"}
+	source := &fixedSource{[]Change{
+		{ChangeDeleted, Document{ID: "known", Path: "Known"}},
+		{ChangeDeleted, Document{ID: "stranger", Path: "Stranger"}},
+	}}
+	configuration := Configuration{HugoPostDirectory: t.TempDir() + "/"}
+	configuration.applyDefaults()
+	syncOnce(t, source, manifest, configuration)
+	if !manifest.Documents["known"].Deleted {
+		t.Errorf("the known document was not marked deleted")
+	}
+	if entry, found := manifest.Documents["stranger"]; found {
+		t.Errorf("the unknown document left %+v", entry)
+	}
+	if deletions := manifest.PendingDeletions(); len(deletions) != 1 || deletions[0].Document.ID != "known" {
+		t.Errorf("pending deletions %+v", deletions)
+	}
+}
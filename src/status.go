@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Where a document is in the editorial workflow, only published documents go on the site
+const (
+	statusDraft     = "draft"
+	statusReview    = "review"
+	statusPublished = "published"
+)
+
+// How far along the workflow each status is
+var statusOrder = map[string]int{
+	statusDraft:     0,
+	statusReview:    1,
+	statusPublished: 2,
+}
+
+// The status the folder of a document gives it, published when StatusFolders does not list the folder
+func documentFolderStatus(document Document, configuration Configuration) string {
+	return deepestFolderMapping(documentFolder(document, configuration), configuration.StatusFolders, statusPublished)
+}
+
+// The status of a document, the less finished of its folder's and the DRVRKR_STATUS it sets,
+// so a piece in Drafts/ stays a draft whatever it says
+func documentStatus(folderStatus string, metadataStatus string) (string, error) {
+	if metadataStatus == "" {
+		return folderStatus, nil
+	}
+	status := strings.ToLower(unescapeMarkdown(metadataStatus))
+	if _, valid := statusOrder[status]; !valid {
+		return "", fmt.Errorf("DRVRKR_STATUS is %q, it must be draft, review or published", metadataStatus)
+	}
+	if statusOrder[status] < statusOrder[folderStatus] {
+		return status, nil
+	}
+	return folderStatus, nil
+}
+
+// Check the StatusFolders setting
+func validateStatusFolders(folders map[string]string) (errs configErrors) {
+	var prefixes []string
+	for folder := range folders {
+		prefixes = append(prefixes, folder)
+	}
+	sort.Strings(prefixes)
+	for _, folder := range prefixes {
+		if strings.Trim(folder, "/") == "" {
+			errs.add("StatusFolders: a folder is empty, documents outside the listed folders are published")
+		}
+		if _, valid := statusOrder[folders[folder]]; !valid {
+			errs.add("StatusFolders: %q maps to %q, it must be \"draft\", \"review\" or \"published\"", folder, folders[folder])
+		}
+	}
+	return errs
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Images an article refers to, both the cover image in the front matter and the inline images
+var articleImageRegex = regexp.MustCompile(`(?:(?m:^\s*"?image"?\s*[:=]\s*")|images/)([^"'\s)]+)`)
+
+func findArticleImages(contents string) (images []string) {
+	found := make(map[string]bool)
+	for _, match := range articleImageRegex.FindAllStringSubmatch(contents, -1) {
+		// The widest variant of an image is both its src and in its srcset
+		if !found[match[1]] {
+			images = append(images, match[1])
+			found[match[1]] = true
+		}
+	}
+	return images
+}
+
+// The images a generated article refers to
+func articleImages(markdownPath string) []string {
+	contents, err := ioutil.ReadFile(markdownPath)
+	if err != nil {
+		return nil
+	}
+	return findArticleImages(string(contents))
+}
+
+// Take down the article of a document that was deleted from the source according to the deletion policy
+func unpublishArticle(article Article, hugoDirectory string, productionDirectory string, previewDirectory string, policy string, archiveDirectory string) error {
+	markdownPath := article.MarkdownPath
+	if markdownPath == "" && article.Slug != "" {
+		section := article.Section
+		if section == "" {
+			section = "articles"
+		}
+		markdownPath = slugMarkdownPath(article.Slug, section, "file", hugoDirectory)
+	} else if markdownPath == "" {
+		markdownPath = legacyArticleMarkdownPath(article.Document.ExportPath, hugoDirectory)
+	}
+	contents, err := ioutil.ReadFile(markdownPath)
+	if os.IsNotExist(err) {
+		fmt.Println("No article to unpublish for " + article.Document.Path)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	images := article.Images
+	if len(images) == 0 {
+		images = findArticleImages(string(contents))
+	}
+	if archiveDirectory == "" {
+		archiveDirectory = hugoDirectory + "archive/"
+	}
+	switch policy {
+	case "", "archive":
+		fmt.Println("Archiving " + markdownPath)
+		err = moveInto(articleLocation(markdownPath), archiveDirectory+path.Dir(contentPath(markdownPath, hugoDirectory))+"/")
+		if err != nil {
+			return err
+		}
+		for _, image := range unusedImages(images, hugoDirectory) {
+			err = moveInto(hugoDirectory+"static/images/"+image, archiveDirectory+"images/")
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	case "delete":
+		fmt.Println("Deleting " + markdownPath)
+		err = os.RemoveAll(articleLocation(markdownPath))
+		if err != nil {
+			return err
+		}
+		for _, image := range unusedImages(images, hugoDirectory) {
+			err = os.Remove(hugoDirectory + "static/images/" + image)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	case "draft":
+		fmt.Println("Marking " + markdownPath + " as a draft")
+		err = writeFileAtomic(markdownPath, []byte(markDraft(string(contents))), 0644)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown deletion policy %q", policy)
+	}
+	siteDirectories := []string{hugoDirectory + "public/", productionDirectory}
+	if previewDirectory != "" {
+		siteDirectories = append(siteDirectories, hugoDirectory+previewBuildDirectory, previewDirectory)
+	}
+	return removeRenderedArticle(markdownPath, hugoDirectory, siteDirectories...)
+}
+
+// hugo never cleans up pages it rendered before and the copies to production and the preview only add files,
+// so remove the rendered article from each of the built sites
+func removeRenderedArticle(markdownPath string, hugoDirectory string, siteDirectories ...string) error {
+	renderedPath := strings.ToLower(contentPath(markdownPath, hugoDirectory)) + "/"
+	for _, siteDirectory := range siteDirectories {
+		err := os.RemoveAll(siteDirectory + renderedPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move a file into a directory, creating the directory if need be
+func moveInto(filePath string, directory string) error {
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(filePath, filepath.Join(directory, filepath.Base(filePath)))
+}
+
+// Leave out images that another article still refers to
+func unusedImages(images []string, hugoDirectory string) (unused []string) {
+	used := make(map[string]bool)
+	filepath.Walk(hugoDirectory+"content/", func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(filePath, ".md") {
+			return nil
+		}
+		contents, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return nil
+		}
+		for _, image := range findArticleImages(string(contents)) {
+			used[image] = true
+		}
+		return nil
+	})
+	for _, image := range images {
+		if !used[image] {
+			unused = append(unused, image)
+		}
+	}
+	return unused
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"html"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnpublishDraftPolicyMarksEveryFrontMatterFormat(t *testing.T) {
+	for format, frontMatter := range map[string]string{
+		"json":        "{\n\"title\": \"Story\",\n\"draft\": false,\n\"slug\": \"story\"\n}\n",
+		"quoted json": "{\n\"title\": \"Story\",\n\"draft\": \"false\",\n\"slug\": \"story\"\n}\n",
+		"toml":        "+++\ntitle = \"Story\"\ndraft = false\n+++\n",
+		"yaml":        "---\ntitle: Story\ndraft: false\n---\n",
+	} {
+		hugoDirectory := t.TempDir() + "/"
+		productionDirectory := t.TempDir() + "/"
+		previewDirectory := t.TempDir() + "/"
+		markdownPath := hugoDirectory + "content/articles/story.md"
+		rendered := []string{
+			hugoDirectory + "public/articles/story/index.html",
+			productionDirectory + "articles/story/index.html",
+			hugoDirectory + "preview/articles/story/index.html",
+			previewDirectory + "articles/story/index.html",
+		}
+		for _, filePath := range append(rendered, markdownPath) {
+			err := os.MkdirAll(filepath.Dir(filePath), 0755)
+			if err == nil {
+				err = ioutil.WriteFile(filePath, []byte(frontMatter+"\nThe story.\n"), 0644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		article := Article{Document: Document{Path: "story.docx"}, MarkdownPath: markdownPath}
+		err := unpublishArticle(article, hugoDirectory, productionDirectory, previewDirectory, "draft", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadFile(markdownPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(contents), "false") || !strings.Contains(string(contents), "true") {
+			t.Errorf("%s front matter was not marked a draft:\n%s", format, contents)
+		}
+		for _, filePath := range rendered {
+			if found, _ := exists(filePath); found {
+				t.Errorf("%s: %s is still there", format, filePath)
+			}
+		}
+	}
+}
+
+// A docx of plain paragraphs for the native converter
+func writeTestDocx(t *testing.T, docxFilePath string, paragraphs ...string) {
+	var body strings.Builder
+	for _, paragraph := range paragraphs {
+		body.WriteString("<w:p><w:r><w:t xml:space=\"preserve\">" + html.EscapeString(paragraph) + "</w:t></w:r></w:p>")
+	}
+	var archive bytes.Buffer
+	writer := zip.NewWriter(&archive)
+	part, err := writer.Create("word/document.xml")
+	if err == nil {
+		_, err = part.Write([]byte(`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` + body.String() + `</w:body></w:document>`))
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = ioutil.WriteFile(docxFilePath, archive.Bytes(), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArticleTurnedDraftIsTakenDown(t *testing.T) {
+	hugoDirectory := t.TempDir() + "/"
+	productionDirectory := t.TempDir() + "/"
+	configuration := Configuration{HugoPostDirectory: hugoDirectory, ProductionDirectory: productionDirectory, Converter: "native"}
+	configuration.applyDefaults()
+	docxFilePath := filepath.Join(t.TempDir(), "story.docx")
+	manifest := NewManifest()
+	document := Document{ID: "d1", Path: "story.docx", ExportPath: docxFilePath}
+	convert := func() *ManifestEntry {
+		hash, err := hashFile(docxFilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := trackArticle(manifest, document, configuration)
+		entry.ExportPath = docxFilePath
+		entry.ExportSHA256 = hash
+		applyPendingChanges(manifest, configuration)
+		if entry.LastError != "" {
+			t.Fatal(entry.LastError)
+		}
+		return entry
+	}
+	writeTestDocx(t, docxFilePath, "A story", "The story.")
+	if entry := convert(); entry.Status != statusPublished {
+		t.Fatalf("the article is %q", entry.Status)
+	}
+	rendered := []string{hugoDirectory + "public/articles/story/index.html", productionDirectory + "articles/story/index.html"}
+	for _, filePath := range rendered {
+		err := os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(filePath, []byte("<p>The story.</p>"), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestDocx(t, docxFilePath, "DRVRKR_STATUS: draft", "A story", "The story.")
+	if entry := convert(); entry.Status != statusDraft {
+		t.Fatalf("the article is %q", entry.Status)
+	}
+	for _, filePath := range rendered {
+		if found, _ := exists(filePath); found {
+			t.Errorf("%s is still there", filePath)
+		}
+	}
+}